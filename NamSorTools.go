@@ -2,8 +2,11 @@ package main
 
 import (
 	"bufio"
-	"crypto/md5"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/antihax/optional"
@@ -11,40 +14,60 @@ import (
 	"github.com/paulrosania/go-charset/charset"
 	_ "github.com/paulrosania/go-charset/data"
 	logger "github.com/sirupsen/logrus"
-	flag "github.com/spf13/pflag"
 	"golang.org/x/net/context"
 	"hash"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
-const DEFAULT_DIGEST_ALGO string = "MD5"
 const BATCH_SIZE int = 100
 
+// STDIO_FILE_NAME stands for stdin as input file, or stdout as output file
+const STDIO_FILE_NAME string = "-"
+const OUTPUT_FILE_SUFFIX string = ".namsor"
+const STATE_FILE_SUFFIX string = ".state"
+
 const INPUT_DATA_FORMAT_FNLN string = "fnln"
 const INPUT_DATA_FORMAT_FNLNGEO string = "fnlngeo"
 const INPUT_DATA_FORMAT_FULLNAME string = "name"
 const INPUT_DATA_FORMAT_FULLNAMEGEO string = "namegeo"
 const INPUT_DATA_FORMAT_FNLNPHONE string = "fnlnphone"
+const INPUT_DATA_FORMAT_FNLNZIP string = "fnlnzip"
+const INPUT_DATA_FORMAT_FNLNNAME string = "fnlnname"
+const INPUT_DATA_FORMAT_FULLNAMEPHONE string = "namephone"
+const INPUT_DATA_FORMAT_FNLNPHONEGEO string = "fnlnphonegeo"
 
-var INPUT_DATA_FORMAT = [5]string{
+var INPUT_DATA_FORMAT = [...]string{
 	INPUT_DATA_FORMAT_FNLN,
 	INPUT_DATA_FORMAT_FNLNGEO,
 	INPUT_DATA_FORMAT_FULLNAME,
 	INPUT_DATA_FORMAT_FULLNAMEGEO,
 	INPUT_DATA_FORMAT_FNLNPHONE,
+	INPUT_DATA_FORMAT_FNLNZIP,
+	INPUT_DATA_FORMAT_FNLNNAME,
+	INPUT_DATA_FORMAT_FULLNAMEPHONE,
+	INPUT_DATA_FORMAT_FNLNPHONEGEO,
 }
 
-var INPUT_DATA_FORMAT_HEADER = [5][]string{
+var INPUT_DATA_FORMAT_HEADER = [...][]string{
 	{"firstName", "lastName"},
 	{"firstName", "lastName", "countryIso2"},
 	{"fullName"},
 	{"fullName", "countryIso2"},
 	{"firstName", "lastName", "phone"},
+	{"firstName", "lastName", "countryIso2", "zip5"},
+	{"firstName", "lastName", "fullName"},
+	{"fullName", "phone"},
+	{"firstName", "lastName", "phone", "countryIso2"},
 }
 
 const SERVICE_NAME_PARSE string = "parse"
@@ -54,6 +77,14 @@ const SERVICE_NAME_COUNTRY string = "country"
 const SERVICE_NAME_DIASPORA string = "diaspora"
 const SERVICE_NAME_PHONECODE string = "phonecode"
 const SERVICE_NAME_USRACEETHNICITY string = "usraceethnicity"
+const SERVICE_NAME_CHINESE_PARSE string = "chineseparse"
+const SERVICE_NAME_CHINESE_PINYIN string = "chinesepinyin"
+const SERVICE_NAME_CHINESE_GENDER string = "chinesegender"
+const SERVICE_NAME_JAPANESE_LATIN string = "japaneselatin"
+const SERVICE_NAME_JAPANESE_KANJI string = "japanesekanji"
+const SERVICE_NAME_JAPANESE_MATCH string = "japanesematch"
+const SERVICE_NAME_CASTEGROUP string = "castegroup"
+const SERVICE_NAME_RELIGION string = "religion"
 
 var SERVICES = []string{
 	SERVICE_NAME_PARSE,
@@ -63,8 +94,30 @@ var SERVICES = []string{
 	SERVICE_NAME_DIASPORA,
 	SERVICE_NAME_PHONECODE,
 	SERVICE_NAME_USRACEETHNICITY,
+	SERVICE_NAME_CHINESE_PARSE,
+	SERVICE_NAME_CHINESE_PINYIN,
+	SERVICE_NAME_CHINESE_GENDER,
+	SERVICE_NAME_JAPANESE_LATIN,
+	SERVICE_NAME_JAPANESE_KANJI,
+	SERVICE_NAME_JAPANESE_MATCH,
+	SERVICE_NAME_CASTEGROUP,
+	SERVICE_NAME_RELIGION,
+}
+
+// geographic context of the geo formats, whether it comes from the input or the --countryIso2 default, and how the service used it
+var OUTPUT_DATA_GEO_CONTEXT_HEADER = []string{
+	"geoContext",
+	"geoContextSource",
+	"geoContextUse",
 }
 
+const GEO_CONTEXT_SOURCE_INPUT string = "input"
+const GEO_CONTEXT_SOURCE_DEFAULT string = "default"
+
+const GEO_CONTEXT_USE_CLASSIFY string = "classify"
+const GEO_CONTEXT_USE_PARSE string = "parse"
+const GEO_CONTEXT_USE_NONE string = "none"
+
 var OUTPUT_DATA_PARSE_HEADER = []string{
 	"firstNameParsed",
 	"lastNameParsed",
@@ -113,6 +166,7 @@ var OUTPUT_DATA_USRACEETHNICITY_HEADER = []string{
 }
 var OUTPUT_DATA_PHONECODE_HEADER = []string{
 	"internationalPhoneNumberVerified",
+	"phoneNumberE164",
 	"phoneCountryIso2Verified",
 	"phoneCountryCode",
 	"phoneCountryCodeAlt",
@@ -124,14 +178,177 @@ var OUTPUT_DATA_PHONECODE_HEADER = []string{
 	"score",
 	"script",
 }
+var OUTPUT_DATA_CHINESE_PARSE_HEADER = []string{
+	"givenNameParsed",
+	"surnameParsed",
+	"nameParserType",
+	"nameParserTypeAlt",
+	"nameParserTypeScore",
+	"script",
+}
+var OUTPUT_DATA_CHINESE_PINYIN_HEADER = []string{
+	"givenNamePinyin",
+	"surnamePinyin",
+	"nameParserType",
+	"nameParserTypeAlt",
+	"nameParserTypeScore",
+	"script",
+}
+var OUTPUT_DATA_CHINESE_GENDER_HEADER = []string{
+	"likelyGender",
+	"likelyGenderScore",
+	"probabilityCalibrated",
+	"genderScale",
+	"script",
+}
+var OUTPUT_DATA_JAPANESE_LATIN_HEADER = []string{
+	"latinName",
+	"latinNameProbability",
+	"latinNameAlt",
+	"latinNameAltProbability",
+	"script",
+}
+var OUTPUT_DATA_JAPANESE_KANJI_HEADER = []string{
+	"kanjiName",
+	"kanjiNameProbability",
+	"kanjiNameAlt",
+	"kanjiNameAltProbability",
+	"script",
+}
+var OUTPUT_DATA_JAPANESE_MATCH_HEADER = []string{
+	"matchStatus",
+	"matchScore",
+	"script",
+}
+var OUTPUT_DATA_CASTEGROUP_HEADER = []string{
+	"castegroup",
+	"castegroupAlt",
+	"probabilityCalibrated",
+	"probabilityCalibratedAlt",
+	"castegroupScore",
+	"script",
+}
+var OUTPUT_DATA_RELIGION_HEADER = []string{
+	"religion",
+	"religionAlt",
+	"probabilityCalibrated",
+	"probabilityCalibratedAlt",
+	"religionScore",
+	"script",
+}
+
+// parsed name columns, before the service columns with --parse-first
+var OUTPUT_DATA_PARSE_FIRST_HEADER = []string{
+	"firstNameParsed",
+	"lastNameParsed",
+	"nameParserType",
+	"nameParserTypeAlt",
+	"nameParserTypeScore",
+}
+
+// services that can chain after parsing full names
+var PARSE_FIRST_SERVICES = []string{
+	SERVICE_NAME_GENDER,
+	SERVICE_NAME_ORIGIN,
+	SERVICE_NAME_DIASPORA,
+	SERVICE_NAME_USRACEETHNICITY,
+}
+
+/*
+	Routes : the API endpoints each row goes through, by input data format and service, ex. parseNameBatch then
+	originBatch for the origin of full names. A combination without a route isn't supported.
+*/
+var SERVICE_ROUTES = map[string][]string{
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_ORIGIN:                 {"originBatch"},
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_GENDER:                 {"genderBatch"},
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_COUNTRY:                {"countryBatch"},
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_CHINESE_GENDER:         {"genderChineseNamePinyinBatch"},
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_JAPANESE_LATIN:         {"japaneseNameLatinCandidatesBatch"},
+	INPUT_DATA_FORMAT_FNLN + "|" + SERVICE_NAME_JAPANESE_KANJI:         {"japaneseNameKanjiCandidatesBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_ORIGIN:              {"originBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_COUNTRY:             {"countryBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_GENDER:              {"genderGeoBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_DIASPORA:            {"diasporaBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_USRACEETHNICITY:     {"usRaceEthnicityBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_CASTEGROUP:          {"castegroupIndianBatch"},
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_RELIGION:            {"religionIndianBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_PARSE:              {"parseNameBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_GENDER:             {"genderFullBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_COUNTRY:            {"countryBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_ORIGIN:             {"parseNameBatch", "originBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_DIASPORA:           {"parseNameBatch", "diasporaBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_USRACEETHNICITY:    {"parseNameBatch", "usRaceEthnicityBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_CHINESE_PARSE:      {"parseChineseNameBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_CHINESE_PINYIN:     {"pinyinChineseNameBatch"},
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_CHINESE_GENDER:     {"genderChineseNameBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_PARSE:           {"parseNameGeoBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_GENDER:          {"genderFullGeoBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_COUNTRY:         {"countryBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_ORIGIN:          {"parseNameGeoBatch", "originBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_DIASPORA:        {"parseNameGeoBatch", "diasporaBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_USRACEETHNICITY: {"parseNameGeoBatch", "usRaceEthnicityBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_CASTEGROUP:      {"castegroupIndianFullBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_RELIGION:        {"religionIndianFullBatch"},
+	INPUT_DATA_FORMAT_FNLNPHONE + "|" + SERVICE_NAME_PHONECODE:         {"phoneCodeBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEPHONE + "|" + SERVICE_NAME_PHONECODE:     {"parseNameBatch", "phoneCodeBatch"},
+	INPUT_DATA_FORMAT_FNLNPHONEGEO + "|" + SERVICE_NAME_PHONECODE:      {"phoneCodeGeoBatch"},
+	INPUT_DATA_FORMAT_FNLNZIP + "|" + SERVICE_NAME_USRACEETHNICITY:     {"usZipRaceEthnicityBatch"},
+	INPUT_DATA_FORMAT_FNLNNAME + "|" + SERVICE_NAME_JAPANESE_MATCH:     {"japaneseNameMatchBatch"},
+}
+
+// with --parse-first, gender of full names goes through the first / last name classifier
+var SERVICE_PARSE_FIRST_ROUTES = map[string][]string{
+	INPUT_DATA_FORMAT_FULLNAME + "|" + SERVICE_NAME_GENDER:    {"parseNameBatch", "genderBatch"},
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_GENDER: {"parseNameGeoBatch", "genderGeoBatch"},
+}
+
+// routes of the geo formats whose classifier doesn't take the geographic context, the others send it to the classifier
+var GEO_CONTEXT_USES = map[string]string{
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_ORIGIN:      GEO_CONTEXT_USE_NONE,
+	INPUT_DATA_FORMAT_FNLNGEO + "|" + SERVICE_NAME_COUNTRY:     GEO_CONTEXT_USE_NONE,
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_COUNTRY: GEO_CONTEXT_USE_NONE,
+	INPUT_DATA_FORMAT_FULLNAMEGEO + "|" + SERVICE_NAME_ORIGIN:  GEO_CONTEXT_USE_PARSE,
+}
+
+// geoContextUse tells how the route of a service for a geo format uses the geographic context
+func geoContextUse(service string, inputDataFormat string) string {
+	if use, ok := GEO_CONTEXT_USES[inputDataFormat+"|"+service]; ok {
+		return use
+	}
+	return GEO_CONTEXT_USE_CLASSIFY
+}
+
+// serviceRoute is the route of a service for an input data format, a usage error when there is none
+func serviceRoute(service string, inputDataFormat string, parseFirst bool) ([]string, error) {
+	key := inputDataFormat + "|" + service
+	if parseFirst {
+		if endpoints, ok := SERVICE_PARSE_FIRST_ROUTES[key]; ok {
+			return endpoints, nil
+		}
+	}
+	endpoints, ok := SERVICE_ROUTES[key]
+	if !ok {
+		return nil, newUsageError(fmt.Sprintf("Service %s doesn't support the input data format %s", service, inputDataFormat))
+	}
+	return endpoints, nil
+}
+
 var OUTPUT_DATA_HEADERS = [][]string{
 	OUTPUT_DATA_PARSE_HEADER,
 	OUTPUT_DATA_GENDER_HEADER,
 	OUTPUT_DATA_ORIGIN_HEADER,
 	OUTPUT_DATA_COUNTRY_HEADER,
 	OUTPUT_DATA_DIASPORA_HEADER,
-	OUTPUT_DATA_USRACEETHNICITY_HEADER,
 	OUTPUT_DATA_PHONECODE_HEADER,
+	OUTPUT_DATA_USRACEETHNICITY_HEADER,
+	OUTPUT_DATA_CHINESE_PARSE_HEADER,
+	OUTPUT_DATA_CHINESE_PINYIN_HEADER,
+	OUTPUT_DATA_CHINESE_GENDER_HEADER,
+	OUTPUT_DATA_JAPANESE_LATIN_HEADER,
+	OUTPUT_DATA_JAPANESE_KANJI_HEADER,
+	OUTPUT_DATA_JAPANESE_MATCH_HEADER,
+	OUTPUT_DATA_CASTEGROUP_HEADER,
+	OUTPUT_DATA_RELIGION_HEADER,
 }
 
 var (
@@ -141,40 +358,91 @@ var (
 	outputFile      string
 	overwrite       bool
 	recover         bool
+	merge           bool
+	parseFirst      bool
+	knownOrigin     bool
 	inputDataFormat string
 	header          bool
 	uid             bool
 	digest          bool
 	service         string
 	encoding        string
+	sheet           string
+	headerRow       int
+	columns         string
+	jsonOutput      bool
+	anonymize       bool
+	noLearn         bool
+	classifier      string
+	schemaFile      string
 )
 
 var uidGen int = 0
 var rowId int = 0
 
+// rows sent to the API, those it returned no answer for, and those below the confidence thresholds
+var rowsSent int = 0
+var rowsFailed int = 0
+var rowsUncertain int = 0
+
+// fileSummary counts the rows of one input file
+type fileSummary struct {
+	inputFileName  string
+	outputFileName string
+	rowsRead       int
+	rowsSkipped    int
+	rowsSent       int
+	rowsFailed     int
+	rowsUncertain  int
+	rowsWritten    int
+}
+
 type NamrSorTools struct {
-	done                        []string
+	done                        map[string]bool
 	separatorOut                string
 	separatorIn                 string
 	auth                        context.Context
+	apiConfig                   *namsorapi.Configuration
 	personalApi                 *namsorapi.PersonalApiService
 	adminApi                    *namsorapi.AdminApiService
 	socialApi                   *namsorapi.SocialApiService
+	chineseApi                  *namsorapi.ChineseApiService
+	japaneseApi                 *namsorapi.JapaneseApiService
 	TIMEOUT                     int
 	withUID                     bool
 	recover                     bool
+	merge                       bool
+	parseFirst                  bool
+	knownOrigin                 bool
+	anonymize                   bool
+	noLearn                     bool
+	parsedNames                 map[string]namsorapi.PersonalNameParsedOut
+	geoDefaulted                map[string]bool
+	sourceFile                  string
+	headerWritten               bool
+	summaries                   []fileSummary
 	skipErrors                  bool
 	digest                      hash.Hash
-	commandLineOptions          map[string]interface{}
+	digestColumns               map[string]bool
+	vault                       *tokenVault
+	encryption                  *outputEncryption
+	stats                       runStats
+	rowGroups                   map[string]string
+	groups                      groupAggregates
+	config                      config
 	firstLastNamesGeoIn         map[string]namsorapi.FirstLastNameGeoIn
 	firstLastNamesIn            map[string]namsorapi.FirstLastNameIn
 	personalNamesIn             map[string]namsorapi.PersonalNameIn
 	personalNamesGeoIn          map[string]namsorapi.PersonalNameGeoIn
 	firstLastNamesPhoneNumberIn map[string]namsorapi.FirstLastNamePhoneNumberIn
+	personalNamesPhoneNumberIn  map[string]personalNamePhoneNumberIn
+	firstLastNamesPhoneGeoIn    map[string]namsorapi.FirstLastNamePhoneNumberGeoIn
+	firstLastNamesGeoZippedIn   map[string]namsorapi.FirstLastNameGeoZippedIn
+	matchPersonalNamesIn        map[string]namsorapi.MatchPersonalFirstLastNameIn
 }
 
-func NewNamSorTools() *NamrSorTools {
-	if apiKey == "" {
+func NewNamSorTools(options config) *NamrSorTools {
+	if options.ApiKey == "" {
 		return nil
 	}
 	config := namsorapi.NewConfiguration()
@@ -185,37 +453,43 @@ func NewNamSorTools() *NamrSorTools {
 		adminApi:     client.AdminApi,
 		personalApi:  client.PersonalApi,
 		socialApi:    client.SocialApi,
+		chineseApi:   client.ChineseApi,
+		japaneseApi:  client.JapaneseApi,
+		apiConfig:    config,
 		auth: context.WithValue(context.Background(), namsorapi.ContextAPIKey, namsorapi.APIKey{
-			Key: apiKey,
+			Key: options.ApiKey,
 		}),
 		TIMEOUT:                     30000,
 		digest:                      nil,
 		skipErrors:                  false,
-		recover:                     recover,
-		withUID:                     uid,
+		recover:                     options.Recover,
+		merge:                       options.Merge,
+		parseFirst:                  options.ParseFirst,
+		knownOrigin:                 options.KnownOrigin,
+		anonymize:                   options.Anonymize,
+		noLearn:                     options.NoLearn,
+		parsedNames:                 map[string]namsorapi.PersonalNameParsedOut{},
+		geoDefaulted:                map[string]bool{},
+		rowGroups:                   map[string]string{},
+		withUID:                     options.Uid,
+		done:                        map[string]bool{},
 		firstLastNamesGeoIn:         map[string]namsorapi.FirstLastNameGeoIn{},
 		firstLastNamesIn:            map[string]namsorapi.FirstLastNameIn{},
 		personalNamesIn:             map[string]namsorapi.PersonalNameIn{},
 		personalNamesGeoIn:          map[string]namsorapi.PersonalNameGeoIn{},
 		firstLastNamesPhoneNumberIn: map[string]namsorapi.FirstLastNamePhoneNumberIn{},
-		commandLineOptions: map[string]interface{}{
-			"apiKey":          apiKey,
-			"inputFile":       inputFile,
-			"countryIso2":     countryIso2,
-			"outputFile":      outputFile,
-			"overwrite":       overwrite,
-			"recover":         recover,
-			"inputDataFormat": inputDataFormat,
-			"header":          header,
-			"uid":             uid,
-			"digest":          digest,
-			"service":         service,
-			"encoding":        encoding,
-		},
-	}
-
-	if digest {
-		tools.digest = md5.New()
+		personalNamesPhoneNumberIn:  map[string]personalNamePhoneNumberIn{},
+		firstLastNamesPhoneGeoIn:    map[string]namsorapi.FirstLastNamePhoneNumberGeoIn{},
+		firstLastNamesGeoZippedIn:   map[string]namsorapi.FirstLastNameGeoZippedIn{},
+		matchPersonalNamesIn:        map[string]namsorapi.MatchPersonalFirstLastNameIn{},
+		config:                      options,
+	}
+
+	if options.Digest {
+		tools.digestColumns = options.DigestColumns
+		if options.Vault == "" {
+			tools.digest = hmac.New(sha256.New, options.DigestKey)
+		}
 	}
 
 	return tools
@@ -244,239 +518,700 @@ func (tools *NamrSorTools) isRecover() bool {
 	return tools.recover
 }
 
+func (tools *NamrSorTools) isMerge() bool {
+	return tools.merge
+}
+
+func (tools *NamrSorTools) isParseFirst() bool {
+	return tools.parseFirst
+}
+
+func (tools *NamrSorTools) isKnownOrigin() bool {
+	return tools.knownOrigin
+}
+
 func (tools *NamrSorTools) getDigest() hash.Hash {
 	return tools.digest
 }
 
-func (tools *NamrSorTools) getCommandLineOptions() map[string]interface{} {
-	return tools.commandLineOptions
+func (tools *NamrSorTools) isDigest() bool {
+	return tools.digest != nil || tools.vault != nil
+}
+
+func (tools *NamrSorTools) getConfig() config {
+	return tools.config
 }
 
-func (tools *NamrSorTools) run() error {
-	if apiKey == "" {
+func (tools *NamrSorTools) run() (err error) {
+	var manifests []*runManifest
+	var creditsUsed *int64
+	// every job is audited, failed ones too, whatever step they failed at
+	defer func() {
+		result := AUDIT_RESULT_OK
+		if err != nil {
+			result = AUDIT_RESULT_FAILED
+		}
+		auditErr := appendAuditLog(tools.getConfig().AuditLog, tools.newAuditEntry(manifests, result, creditsUsed))
+		if auditErr != nil && err == nil {
+			err = errors.New(fmt.Sprintf("can't write the audit log : %s", auditErr.Error()))
+		} else if auditErr != nil {
+			logger.Errorf("Can't write the audit log : %s", auditErr.Error())
+		}
+	}()
+	if tools.getConfig().ApiKey == "" {
 		return errors.New("missing api-key")
 	}
 	softwareNameAndVersion, _, err := tools.adminApi.SoftwareVersion(context.Background())
 	if err != nil {
-		logger.Fatalf(err.Error())
 		return errors.New(fmt.Sprintf("can't get api-version %s", err.Error()))
 	}
+	startedAt := time.Now()
+	usageBefore, usageErr := tools.billingPeriodUsage()
+	settings, err := tools.runWithApiSettings(softwareNameAndVersion)
 
-	service := tools.getCommandLineOptions()["service"].(string)
-	inputFileName := tools.getCommandLineOptions()["inputFile"].(string)
-	if inputFileName == "" {
-		return errors.New("missing input file")
+	if usageErr == nil {
+		var usageAfter int64
+		usageAfter, usageErr = tools.billingPeriodUsage()
+		if usageErr == nil && usageAfter >= usageBefore {
+			used := usageAfter - usageBefore
+			creditsUsed = &used
+		}
+	}
+	if creditsUsed == nil {
+		logger.Warn("Can't read the credits used from the API usage, they aren't in the manifest")
 	}
-	inputFile, err := os.Open(inputFileName)
 	if err != nil {
-		logger.Fatal(err.Error())
-		return errors.New(err.Error())
+		return err
 	}
-
-	outputFileName := tools.getCommandLineOptions()["outputFile"].(string)
-	if outputFileName == "" {
-		outputFileName = inputFileName + "." + service
-		if digest {
-			outputFileName += ".digest"
+	tools.logThresholdSummary()
+	report := tools.newRunReport(startedAt)
+	logRunReport(report)
+	if tools.getConfig().ReportFile != "" {
+		err = writeRunReport(tools.getConfig().ReportFile, report)
+		if err != nil {
+			return err
 		}
-		outputFileName += ".namsor"
-		logger.Info(fmt.Sprintf("Outputing to %s", outputFileName))
 	}
-
-	outputFileExists := false
-	outputFileOverwrite := tools.getCommandLineOptions()["overwrite"].(bool)
-	if _, err := os.Stat(outputFileName); err == nil {
-		if !outputFileOverwrite && !tools.isRecover() {
-			return errors.New(fmt.Sprintf("OutputFile %s already exsists, user -r to recover and continue job", inputFileName))
-		}
-		outputFileExists = true
+	manifests, err = tools.buildManifests(softwareNameAndVersion.SoftwareNameAndVersion, startedAt, settings, creditsUsed)
+	if err == nil {
+		err = writeManifests(manifests)
 	}
-	if outputFileOverwrite && tools.isRecover() {
-		return errors.New(fmt.Sprintf("You can overwrite OR  recover to %s", outputFileName))
+	if err != nil {
+		return err
 	}
-	if tools.isRecover() && !tools.isWithUID() {
-		return errors.New(fmt.Sprintf("You can't recover without a uid %s", outputFileName))
+	if settings != nil && !settings.Restored {
+		return errors.New("the API key settings weren't restored, see the log")
+	}
+	return nil
+}
+
+func (tools *NamrSorTools) runFiles(softwareNameAndVersion namsorapi.SoftwareVersionOut) error {
+	service := tools.getConfig().Service
+	inputFileName := tools.getConfig().InputFile
+	if inputFileName == "" {
+		return errors.New("missing input file")
 	}
-	if encoding == "" {
-		encoding = "UTF-8"
+	if tools.config.Encoding == "" {
+		tools.config.Encoding = "UTF-8"
 	}
+	outputFileName := tools.getConfig().OutputFile
 
-	if tools.isRecover() && outputFileExists {
-		logger.Infof("Recovering from existing %s", outputFileName)
-		outFile, err := os.Open(outputFileName)
-		if err != nil {
-			logger.Fatal(err.Error())
-			return errors.New(err.Error())
-		}
-		r, err := charset.NewReader(encoding, io.Reader(outFile))
-		if err != nil {
-			logger.Fatal(err.Error())
-			return errors.New(err.Error())
+	inputFileNames, err := expandInputFiles(inputFileName)
+	if err != nil {
+		return err
+	}
+	if len(inputFileNames) == 0 {
+		return errors.New(fmt.Sprintf("No input file matching %s", inputFileName))
+	}
+	multiple := len(inputFileNames) > 1 || inputFileNames[0] != inputFileName
+	if !multiple && !tools.isMerge() {
+		if outputFileName == "" {
+			outputFileName = tools.outputFileNameFor(inputFileName, service)
 		}
-		readerDone := bufio.NewReader(r)
-		doneLine, err := readerDone.ReadString('\n')
+		summary, err := tools.runFile(service, inputFileName, outputFileName, softwareNameAndVersion.SoftwareNameAndVersion)
 		if err != nil {
-			logger.Fatal(err.Error())
-			return errors.New(err.Error())
+			return err
 		}
-		line := 0
-		length := -1
-
-		for doneLine != "" {
-			if doneLine[0] == '#' {
-				existingData := strings.Split(doneLine, "\\|")
-				if length < 0 {
-					length = len(existingData)
-				} else if length != len(existingData) {
-					logger.Warnf("Line %d doneLine = %s len=%d!=%d", line, doneLine, len(existingData), length)
-				}
-				tools.done = append(tools.done, existingData[0])
-			}
+		tools.summaries = append(tools.summaries, summary)
+		return nil
+	}
 
-			doneLine, err = readerDone.ReadString('\n')
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				logger.Fatal(err.Error())
-				return errors.New(err.Error())
-			}
+	if tools.isMerge() {
+		err = tools.runMerged(service, inputFileName, inputFileNames, outputFileName, softwareNameAndVersion.SoftwareNameAndVersion)
+	} else {
+		err = tools.runEach(service, inputFileNames, outputFileName, softwareNameAndVersion.SoftwareNameAndVersion)
+	}
+	tools.logSummary()
+	return err
+}
 
-			if line%100000 == 0 {
-				logger.Infof("Loading from existing %s : %d", outputFileName, line)
-			}
-			line++
+// expandInputFiles lists the input files for a file name, a directory or a glob pattern
+func expandInputFiles(inputFileName string) ([]string, error) {
+	if inputFileName == STDIO_FILE_NAME {
+		return []string{inputFileName}, nil
+	}
+	var candidates []string
+	if info, err := os.Stat(inputFileName); err == nil {
+		if !info.IsDir() {
+			return []string{inputFileName}, nil
 		}
-		err = outFile.Close()
+		entries, err := ioutil.ReadDir(inputFileName)
 		if err != nil {
-			return errors.New(err.Error())
+			return nil, err
+		}
+		for _, entry := range entries {
+			candidates = append(candidates, filepath.Join(inputFileName, entry.Name()))
+		}
+	} else {
+		candidates, err = filepath.Glob(inputFileName)
+		if err != nil {
+			return nil, err
 		}
 	}
-
-	r, errR := charset.NewReader(encoding, io.Reader(inputFile))
-	if errR != nil {
-		logger.Fatal(errR.Error())
-		return errors.New(errR.Error())
+	var inputFileNames []string
+	for _, candidate := range candidates {
+		base := filepath.Base(candidate)
+		if strings.HasPrefix(base, ".") || strings.HasSuffix(trimEncryptedSuffix(base), OUTPUT_FILE_SUFFIX) || strings.HasSuffix(base, STATE_FILE_SUFFIX) || strings.HasSuffix(base, MANIFEST_FILE_SUFFIX) {
+			// hidden files, outputs, job states and manifests of previous runs
+			continue
+		}
+		if info, err := os.Stat(candidate); err != nil || info.IsDir() {
+			continue
+		}
+		inputFileNames = append(inputFileNames, candidate)
 	}
+	sort.Strings(inputFileNames)
+	return inputFileNames, nil
+}
 
-	outFile, err := os.OpenFile(outputFileName, os.O_CREATE|os.O_TRUNC, 0660)
-	if err != nil {
-		logger.Fatal(err.Error())
-		return errors.New(err.Error())
+func (tools *NamrSorTools) outputFileNameFor(inputFileName string, service string) string {
+	if inputFileName == STDIO_FILE_NAME {
+		return STDIO_FILE_NAME
 	}
-	w, errW := charset.NewWriter(encoding, outFile)
-	if errW != nil {
-		logger.Fatal(errW.Error())
-		return errors.New(errW.Error())
+	outputFileName := inputFileName + "." + service
+	if tools.isGroupBy() {
+		outputFileName += GROUP_FILE_SUFFIX
 	}
-
-	reader := bufio.NewReader(r)
-	writer := bufio.NewWriter(w)
-
-	err = tools.process(service, reader, writer, softwareNameAndVersion.SoftwareNameAndVersion)
-	if err != nil {
-		return errors.New(err.Error())
+	if tools.getConfig().Digest {
+		outputFileName += ".digest"
 	}
-	err = outFile.Close()
-	if err != nil {
-		return errors.New(err.Error())
+	outputFileName += OUTPUT_FILE_SUFFIX
+	if isXlsx(inputFileName) {
+		outputFileName += XLSX_FILE_SUFFIX
 	}
-	err = inputFile.Close()
-	if err != nil {
-		return errors.New(err.Error())
+	if tools.encryption != nil {
+		outputFileName += tools.encryption.fileSuffix()
 	}
-	return nil
+	logger.Info(fmt.Sprintf("Outputing to %s", outputFileName))
+	return outputFileName
 }
 
-// equal to digest(string)
-func (tools *NamrSorTools) digestText(inClear string) string {
-	if tools.getDigest() == nil || inClear == "" {
-		return inClear
+// runEach enriches every input file into its own output file, in the outputDir directory if any
+func (tools *NamrSorTools) runEach(service string, inputFileNames []string, outputDir string, softwareNameAndVersion string) error {
+	if outputDir == STDIO_FILE_NAME {
+		return errors.New("Use --merge to output several input files to stdout")
 	}
-	tools.digest.Write([]byte(inClear))
-	return hex.EncodeToString(tools.digest.Sum(nil))
-}
-
-func (tools *NamrSorTools) computeScriptFirst(someString string) string {
-	for i := 1; i < len(someString); i++ {
-		c := []rune(someString)[i]
-		if unicode.In(c, unicode.Common) {
-			continue
+	if outputDir != "" {
+		if info, err := os.Stat(outputDir); err != nil || !info.IsDir() {
+			return errors.New(fmt.Sprintf("With several input files, %s should be a directory or use --merge", outputDir))
 		}
-		for name, table := range unicode.Categories {
-			if unicode.Is(table, c) {
-				return name
+	}
+	for _, inputFileName := range inputFileNames {
+		outputFileName := tools.outputFileNameFor(inputFileName, service)
+		if outputDir != "" {
+			outputFileName = filepath.Join(outputDir, filepath.Base(outputFileName))
+		}
+		stateFileName := outputFileName + STATE_FILE_SUFFIX
+		if tools.isRecover() {
+			state, err := loadJobState(stateFileName)
+			if err != nil {
+				return err
+			}
+			if summary, ok := state[inputFileName]; ok {
+				logger.Infof("Skipping %s, already done", inputFileName)
+				tools.summaries = append(tools.summaries, summary)
+				continue
 			}
 		}
+		summary, err := tools.runFile(service, inputFileName, outputFileName, softwareNameAndVersion)
+		if err != nil {
+			return inFile(inputFileName, err)
+		}
+		tools.summaries = append(tools.summaries, summary)
+		err = appendJobState(stateFileName, summary, !tools.isRecover())
+		if err != nil {
+			return err
+		}
 	}
-	return ""
+	return nil
 }
 
-/*
-	API Calls
-*/
-func (tools *NamrSorTools) processDiaspora(names []namsorapi.FirstLastNameGeoIn) (map[string]namsorapi.FirstLastNameDiasporaedOut, error) {
-	result := map[string]namsorapi.FirstLastNameDiasporaedOut{}
-	data := namsorapi.BatchFirstLastNameGeoIn{names}
-	body := namsorapi.DiasporaBatchOpts{
-		BatchFirstLastNameGeoIn: optional.NewInterface(data),
+// runMerged enriches every input file into one output file, with a sourceFile column
+func (tools *NamrSorTools) runMerged(service string, inputFileName string, inputFileNames []string, outputFileName string, softwareNameAndVersion string) (err error) {
+	if outputFileName == "" {
+		info, err := os.Stat(inputFileName)
+		if err != nil || !info.IsDir() {
+			return errors.New("Merging files from a pattern requires an output file name")
+		}
+		outputFileName = tools.outputFileNameFor(strings.TrimRight(inputFileName, string(filepath.Separator)), service)
 	}
-	origined, _, err := tools.personalApi.DiasporaBatch(tools.auth, &body)
+	tools.groups.reset()
+	outFile, writer, err := tools.openOutput(outputFileName)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	for _, personalName := range origined.PersonalNames {
-		result[personalName.Id] = personalName
+	// closed on errors too, so that an encrypted output stays readable up to the last rows written
+	defer func() {
+		closeErr := tools.closeOutput(outFile)
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	stateFileName := outputFileName + STATE_FILE_SUFFIX
+	state := map[string]fileSummary{}
+	if outputFileName != STDIO_FILE_NAME && tools.isRecover() {
+		state, err = loadJobState(stateFileName)
+		if err != nil {
+			return err
+		}
 	}
-	return result, nil
+	for i, inputFileName := range inputFileNames {
+		if isXlsx(inputFileName) {
+			return errors.New(fmt.Sprintf("Excel file %s can't be merged", inputFileName))
+		}
+		if summary, ok := state[inputFileName]; ok {
+			logger.Infof("Skipping %s, already done", inputFileName)
+			tools.summaries = append(tools.summaries, summary)
+			continue
+		}
+		tools.sourceFile = inputFileName
+		summary, err := tools.processFile(service, inputFileName, writer, softwareNameAndVersion)
+		if err != nil {
+			return inFile(inputFileName, err)
+		}
+		summary.outputFileName = outputFileName
+		tools.summaries = append(tools.summaries, summary)
+		if outputFileName != STDIO_FILE_NAME {
+			err = appendJobState(stateFileName, summary, i == 0 && !tools.isRecover())
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if tools.isGroupBy() {
+		return tools.writeGroups(writer)
+	}
+	return nil
 }
 
-func (tools *NamrSorTools) processOrigin(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.FirstLastNameOriginedOut, error) {
-	result := map[string]namsorapi.FirstLastNameOriginedOut{}
-	data := namsorapi.BatchFirstLastNameIn{
-		names,
+// runFile enriches one input file into one output file
+func (tools *NamrSorTools) runFile(service string, inputFileName string, outputFileName string, softwareNameAndVersion string) (summary fileSummary, err error) {
+	if isXlsx(inputFileName) {
+		return tools.runXlsx(service, inputFileName, outputFileName, softwareNameAndVersion)
 	}
-	body := namsorapi.OriginBatchOpts{
-		BatchFirstLastNameIn: optional.NewInterface(data),
+	tools.done = map[string]bool{}
+	tools.headerWritten = false
+	tools.groups.reset()
+	outFile, writer, err := tools.openOutput(outputFileName)
+	if err != nil {
+		return summary, err
 	}
-	origined, _, err := tools.personalApi.OriginBatch(tools.auth, &body)
+	defer func() {
+		closeErr := tools.closeOutput(outFile)
+		if err == nil {
+			err = closeErr
+		}
+	}()
+	summary, err = tools.processFile(service, inputFileName, writer, softwareNameAndVersion)
 	if err != nil {
-		return nil, err
+		return summary, err
 	}
-	for _, personalName := range origined.PersonalNames {
-		result[personalName.Id] = personalName
+	summary.outputFileName = outputFileName
+	if tools.isGroupBy() {
+		return summary, tools.writeGroups(writer)
 	}
-	return result, nil
+	return summary, nil
 }
 
-func (tools *NamrSorTools) processOriginGeo(names []namsorapi.FirstLastNameGeoIn) (map[string]namsorapi.FirstLastNameOriginedOut, error) {
-	var namesNoGeo []namsorapi.FirstLastNameIn
-	for _, name := range names {
-		nameNoGeo := namsorapi.FirstLastNameIn{
-			name.Id,
-			name.FirstName,
-			name.LastName,
+func (tools *NamrSorTools) processFile(service string, inputFileName string, writer *bufio.Writer, softwareNameAndVersion string) (fileSummary, error) {
+	summary := fileSummary{inputFileName: inputFileName}
+	var inputFile *os.File
+	var err error
+	if inputFileName == STDIO_FILE_NAME {
+		inputFile = os.Stdin
+	} else {
+		inputFile, err = os.Open(inputFileName)
+		if err != nil {
+			return summary, errors.New(err.Error())
 		}
-		namesNoGeo = append(namesNoGeo, nameNoGeo)
 	}
+	r, errR := charset.NewReader(tools.getConfig().Encoding, io.Reader(inputFile))
+	if errR != nil {
+		return summary, errors.New(errR.Error())
+	}
+	reader := bufio.NewReader(r)
 
-	return tools.processOrigin(namesNoGeo)
+	rowIdBefore, rowsSentBefore, rowsFailedBefore, rowsUncertainBefore := rowId, rowsSent, rowsFailed, rowsUncertain
+	err = tools.process(service, reader, writer, softwareNameAndVersion, &summary)
+	if err != nil {
+		return summary, err
+	}
+	summary.rowsWritten = rowId - rowIdBefore
+	summary.rowsSent = rowsSent - rowsSentBefore
+	summary.rowsFailed = rowsFailed - rowsFailedBefore
+	summary.rowsUncertain = rowsUncertain - rowsUncertainBefore
+	if inputFile != os.Stdin {
+		err = inputFile.Close()
+		if err != nil {
+			return summary, errors.New(err.Error())
+		}
+	}
+	return summary, nil
 }
 
-func (tools *NamrSorTools) processGender(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.FirstLastNameGenderedOut, error) {
-	result := map[string]namsorapi.FirstLastNameGenderedOut{}
-	data := namsorapi.BatchFirstLastNameIn{
-		names,
+// openOutput checks the overwrite / recover options, loads the recovered uids and opens the output for writing
+func (tools *NamrSorTools) openOutput(outputFileName string) (*encryptedOutput, *bufio.Writer, error) {
+	outputFileExists := false
+	outputFileOverwrite := tools.getConfig().Overwrite
+	if outputFileName == STDIO_FILE_NAME {
+		if tools.isRecover() {
+			return nil, nil, errors.New("You can't recover when outputing to stdout")
+		}
+	} else if _, err := os.Stat(outputFileName); err == nil {
+		if !outputFileOverwrite && !tools.isRecover() {
+			return nil, nil, errors.New(fmt.Sprintf("OutputFile %s already exsists, user -r to recover and continue job", outputFileName))
+		}
+		outputFileExists = true
 	}
-	body := namsorapi.GenderBatchOpts{
-		BatchFirstLastNameIn: optional.NewInterface(data),
+	if outputFileOverwrite && tools.isRecover() {
+		return nil, nil, errors.New(fmt.Sprintf("You can overwrite OR  recover to %s", outputFileName))
+	}
+	if tools.isRecover() && !tools.isWithUID() {
+		return nil, nil, errors.New(fmt.Sprintf("You can't recover without a uid %s", outputFileName))
+	}
+
+	output := &encryptedOutput{}
+	var err error
+	if outputFileName == STDIO_FILE_NAME {
+		output.file = os.Stdout
+	} else if tools.encryption != nil && tools.isRecover() && outputFileExists {
+		// encrypted rows can't be appended to, they are encrypted again with the new rows
+		output.file, err = os.OpenFile(outputFileName+RESUME_FILE_SUFFIX, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		output.renameTo = outputFileName
+	} else {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if tools.isRecover() {
+			// keep the rows done so far
+			flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		}
+		output.file, err = os.OpenFile(outputFileName, flags, 0660)
 	}
-	gendered, _, err := tools.personalApi.GenderBatch(tools.auth, &body)
 	if err != nil {
-		return nil, err
+		return nil, nil, errors.New(err.Error())
 	}
-	for _, personalName := range gendered.PersonalNames {
-		result[personalName.Id] = personalName
+	if tools.encryption != nil {
+		output.encrypter, err = tools.encryption.encrypt(output.file)
+		if err != nil {
+			output.encrypter = nil
+			output.abort()
+			return nil, nil, err
+		}
+	}
+
+	if tools.isRecover() && outputFileExists {
+		err := tools.loadDone(outputFileName, output.writer())
+		if err != nil {
+			output.abort()
+			return nil, nil, err
+		}
+	}
+
+	w, errW := charset.NewWriter(tools.getConfig().Encoding, output.writer())
+	if errW != nil {
+		output.abort()
+		return nil, nil, errors.New(errW.Error())
+	}
+	return output, bufio.NewWriter(w), nil
+}
+
+func (tools *NamrSorTools) closeOutput(outFile *encryptedOutput) error {
+	err := outFile.Close()
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	return nil
+}
+
+// loadDone reads the uids already in an existing output file, to recover a job; an encrypted one is decrypted and copied to the new output
+func (tools *NamrSorTools) loadDone(outputFileName string, encryptedCopy io.Writer) error {
+	logger.Infof("Recovering from existing %s", outputFileName)
+	outFile, err := os.Open(outputFileName)
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	var existing io.Reader = outFile
+	if tools.encryption != nil {
+		existing, err = tools.encryption.decrypt(outFile, tools.getConfig().Identity)
+		if err != nil {
+			outFile.Close()
+			return err
+		}
+		existing = io.TeeReader(existing, encryptedCopy)
+	}
+	r, err := charset.NewReader(tools.getConfig().Encoding, existing)
+	if err != nil {
+		outFile.Close()
+		return errors.New(err.Error())
+	}
+	readerDone := bufio.NewReader(r)
+	line := 0
+	length := -1
+	for {
+		doneLine, err := readerDone.ReadString('\n')
+		if err != nil && err != io.EOF {
+			outFile.Close()
+			if tools.encryption != nil {
+				// the encrypted stream of a killed job has no final chunk, its rows can't be trusted
+				return errors.New(fmt.Sprintf("The encrypted output %s isn't finalized, the job was interrupted : run it again with -w (%s)", outputFileName, err.Error()))
+			}
+			return errors.New(err.Error())
+		}
+		doneLine = strings.TrimRight(doneLine, "\r\n")
+		if doneLine != "" && doneLine[0] != '#' {
+			existingData := strings.Split(doneLine, tools.separatorOut)
+			if length < 0 {
+				length = len(existingData)
+			} else if length != len(existingData) {
+				logger.WithFields(recordFields(line, LOG_REASON_DONE_LINE_FORMAT, doneLine)).Warnf("Line %d of the existing output : %d columns, expected %d", line, len(existingData), length)
+			}
+			tools.done[tools.doneKey(existingData[0], existingData[len(existingData)-1])] = true
+		}
+		if err == io.EOF {
+			break
+		}
+		if line%100000 == 0 {
+			logger.Infof("Loading from existing %s : %d", outputFileName, line)
+		}
+		line++
+	}
+	err = outFile.Close()
+	if err != nil {
+		return errors.New(err.Error())
+	}
+	return nil
+}
+
+// doneKey identifies a row for recovery; in a merged output, uids are only unique within their source file
+func (tools *NamrSorTools) doneKey(uid string, sourceFile string) string {
+	if !tools.merge {
+		return uid
+	}
+	return sourceFile + tools.separatorOut + uid
+}
+
+// loadJobState reads the input files completed in a job, one per line : inputFile|outputFile|read|skipped|written|sent|failed|uncertain
+func loadJobState(stateFileName string) (map[string]fileSummary, error) {
+	state := map[string]fileSummary{}
+	content, err := ioutil.ReadFile(stateFileName)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		data := strings.Split(line, "|")
+		// the sent and failed counts are missing from the state of older versions
+		if len(data) != 5 && len(data) != 7 && len(data) != 8 {
+			continue
+		}
+		summary := fileSummary{inputFileName: data[0], outputFileName: data[1]}
+		summary.rowsRead, _ = strconv.Atoi(data[2])
+		summary.rowsSkipped, _ = strconv.Atoi(data[3])
+		summary.rowsWritten, _ = strconv.Atoi(data[4])
+		if len(data) >= 7 {
+			summary.rowsSent, _ = strconv.Atoi(data[5])
+			summary.rowsFailed, _ = strconv.Atoi(data[6])
+		}
+		if len(data) == 8 {
+			summary.rowsUncertain, _ = strconv.Atoi(data[7])
+		}
+		state[summary.inputFileName] = summary
+	}
+	return state, nil
+}
+
+// appendJobState marks an input file as completed
+func appendJobState(stateFileName string, summary fileSummary, truncate bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	stateFile, err := os.OpenFile(stateFileName, flags, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = stateFile.WriteString(fmt.Sprintf("%s|%s|%d|%d|%d|%d|%d|%d\n", summary.inputFileName, summary.outputFileName, summary.rowsRead, summary.rowsSkipped, summary.rowsWritten, summary.rowsSent, summary.rowsFailed, summary.rowsUncertain))
+	if err != nil {
+		stateFile.Close()
+		return err
+	}
+	return stateFile.Close()
+}
+
+func (tools *NamrSorTools) logSummary() {
+	for _, summary := range tools.summaries {
+		logger.Infof("%s -> %s : read %d, skipped %d, sent %d, failed %d, uncertain %d, written %d", summary.inputFileName, summary.outputFileName, summary.rowsRead, summary.rowsSkipped, summary.rowsSent, summary.rowsFailed, summary.rowsUncertain, summary.rowsWritten)
+	}
+	total := tools.totalSummary()
+	logger.Infof("%d files : read %d, skipped %d, sent %d, failed %d, uncertain %d, written %d", len(tools.summaries), total.rowsRead, total.rowsSkipped, total.rowsSent, total.rowsFailed, total.rowsUncertain, total.rowsWritten)
+}
+
+// pseudonym of a value of the column with --digest, HMAC-SHA256 with the secret key or a token of the vault, the value itself otherwise
+func (tools *NamrSorTools) digestText(column string, inClear string) (string, error) {
+	if !tools.isDigest() || !tools.digestColumns[column] || inClear == "" {
+		return inClear, nil
+	}
+	if tools.vault != nil {
+		return tools.vault.token(column, inClear)
+	}
+	tools.digest.Reset()
+	tools.digest.Write([]byte(inClear))
+	return hex.EncodeToString(tools.digest.Sum(nil)), nil
+}
+
+// computeScriptFirst returns the script of the first letter, ex. Latin, Han, Cyrillic
+func (tools *NamrSorTools) computeScriptFirst(someString string) string {
+	for _, c := range someString {
+		if unicode.In(c, unicode.Common, unicode.Inherited) {
+			continue
+		}
+		for name, table := range unicode.Scripts {
+			if name != "Common" && name != "Inherited" && unicode.Is(table, c) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+/*
+	API Calls
+*/
+
+// callApi sends a JSON request to the API, for the endpoints that the SDK doesn't map to the right types
+func (tools *NamrSorTools) callApi(method string, path string, in interface{}, out interface{}) error {
+	var body io.Reader = nil
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	request, err := http.NewRequest(method, tools.apiConfig.BasePath+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("User-Agent", tools.apiConfig.UserAgent)
+	request.Header.Set("X-API-KEY", tools.auth.Value(namsorapi.ContextAPIKey).(namsorapi.APIKey).Key)
+	response, err := tools.apiConfig.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("%s %s : %s", method, path, response.Status))
+	}
+	return json.NewDecoder(response.Body).Decode(out)
+}
+func (tools *NamrSorTools) processDiaspora(names []namsorapi.FirstLastNameGeoIn) (map[string]namsorapi.FirstLastNameDiasporaedOut, error) {
+	result := map[string]namsorapi.FirstLastNameDiasporaedOut{}
+	data := namsorapi.BatchFirstLastNameGeoIn{names}
+	body := namsorapi.DiasporaBatchOpts{
+		BatchFirstLastNameGeoIn: optional.NewInterface(data),
+	}
+	origined, _, err := tools.personalApi.DiasporaBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range origined.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processOrigin(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.FirstLastNameOriginedOut, error) {
+	result := map[string]namsorapi.FirstLastNameOriginedOut{}
+	data := namsorapi.BatchFirstLastNameIn{
+		names,
+	}
+	body := namsorapi.OriginBatchOpts{
+		BatchFirstLastNameIn: optional.NewInterface(data),
+	}
+	origined, _, err := tools.personalApi.OriginBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range origined.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// withoutGeo drops the geographic context of first / last names, for the classifiers that don't take one
+func withoutGeo(names []namsorapi.FirstLastNameGeoIn) []namsorapi.FirstLastNameIn {
+	var namesNoGeo []namsorapi.FirstLastNameIn
+	for _, name := range names {
+		namesNoGeo = append(namesNoGeo, namsorapi.FirstLastNameIn{
+			Id:        name.Id,
+			FirstName: name.FirstName,
+			LastName:  name.LastName,
+		})
+	}
+	return namesNoGeo
+}
+
+// processCountryGeo infers the country of residence of full names with a geographic context, which the country classifier doesn't take
+func (tools *NamrSorTools) processCountryGeo(names []namsorapi.PersonalNameGeoIn) (map[string]namsorapi.PersonalNameGeoOut, error) {
+	var namesNoGeo []namsorapi.PersonalNameIn
+	for _, name := range names {
+		namesNoGeo = append(namesNoGeo, namsorapi.PersonalNameIn{
+			Id:   name.Id,
+			Name: name.Name,
+		})
+	}
+	return tools.processCountry(namesNoGeo)
+}
+
+// processCountryGeoAdapted infers the country of residence of first / last names with a geographic context
+func (tools *NamrSorTools) processCountryGeoAdapted(names []namsorapi.FirstLastNameGeoIn) (map[string]namsorapi.PersonalNameGeoOut, error) {
+	var namesNoGeo []namsorapi.PersonalNameIn
+	for _, name := range names {
+		namesNoGeo = append(namesNoGeo, namsorapi.PersonalNameIn{
+			Id:   name.Id,
+			Name: name.FirstName + " " + name.LastName,
+		})
+	}
+	return tools.processCountry(namesNoGeo)
+}
+
+func (tools *NamrSorTools) processGender(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.FirstLastNameGenderedOut, error) {
+	result := map[string]namsorapi.FirstLastNameGenderedOut{}
+	data := namsorapi.BatchFirstLastNameIn{
+		names,
+	}
+	body := namsorapi.GenderBatchOpts{
+		BatchFirstLastNameIn: optional.NewInterface(data),
+	}
+	gendered, _, err := tools.personalApi.GenderBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range gendered.PersonalNames {
+		result[personalName.Id] = personalName
 	}
 	return result, nil
 }
@@ -602,6 +1337,188 @@ func (tools *NamrSorTools) processParseGeo(names []namsorapi.PersonalNameGeoIn)
 	return result, nil
 }
 
+func (tools *NamrSorTools) processChineseParse(names []namsorapi.PersonalNameIn) (map[string]namsorapi.PersonalNameParsedOut, error) {
+	result := map[string]namsorapi.PersonalNameParsedOut{}
+	data := namsorapi.BatchPersonalNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.ParseChineseNameBatchOpts{
+		BatchPersonalNameIn: optional.NewInterface(data),
+	}
+	parsed, _, err := tools.chineseApi.ParseChineseNameBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range parsed.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processChinesePinyin(names []namsorapi.PersonalNameIn) (map[string]namsorapi.PersonalNameParsedOut, error) {
+	result := map[string]namsorapi.PersonalNameParsedOut{}
+	data := namsorapi.BatchPersonalNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.PinyinChineseNameBatchOpts{
+		BatchPersonalNameIn: optional.NewInterface(data),
+	}
+	pinyins, _, err := tools.chineseApi.PinyinChineseNameBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range pinyins.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processChineseGender(names []namsorapi.PersonalNameIn) (map[string]namsorapi.PersonalNameGenderedOut, error) {
+	result := map[string]namsorapi.PersonalNameGenderedOut{}
+	data := namsorapi.BatchPersonalNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.GenderChineseNameBatchOpts{
+		BatchPersonalNameIn: optional.NewInterface(data),
+	}
+	gendered, _, err := tools.chineseApi.GenderChineseNameBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range gendered.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// processChineseGenderPinyin infers the gender of Chinese names in pinyin, as first (given) and last (sur) names
+func (tools *NamrSorTools) processChineseGenderPinyin(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.FirstLastNameGenderedOut, error) {
+	result := map[string]namsorapi.FirstLastNameGenderedOut{}
+	data := namsorapi.BatchFirstLastNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.GenderChineseNamePinyinBatchOpts{
+		BatchFirstLastNameIn: optional.NewInterface(data),
+	}
+	gendered, _, err := tools.chineseApi.GenderChineseNamePinyinBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range gendered.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// processJapaneseLatin suggests Latin candidates for Japanese names in kanji, as first (given) and last (sur) names
+func (tools *NamrSorTools) processJapaneseLatin(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.NameMatchCandidatesOut, error) {
+	result := map[string]namsorapi.NameMatchCandidatesOut{}
+	data := namsorapi.BatchFirstLastNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.JapaneseNameLatinCandidatesBatchOpts{
+		BatchFirstLastNameIn: optional.NewInterface(data),
+	}
+	candidates, _, err := tools.japaneseApi.JapaneseNameLatinCandidatesBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range candidates.NamesAndMatchCandidates {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// processJapaneseKanji suggests kanji candidates for Japanese names in Latin script, as first (given) and last (sur) names
+func (tools *NamrSorTools) processJapaneseKanji(names []namsorapi.FirstLastNameIn) (map[string]namsorapi.NameMatchCandidatesOut, error) {
+	result := map[string]namsorapi.NameMatchCandidatesOut{}
+	data := namsorapi.BatchFirstLastNameIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.JapaneseNameKanjiCandidatesBatchOpts{
+		BatchFirstLastNameIn: optional.NewInterface(data),
+	}
+	candidates, _, err := tools.japaneseApi.JapaneseNameKanjiCandidatesBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range candidates.NamesAndMatchCandidates {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// processJapaneseMatch scores whether a name in Latin script (name1) and a name in kanji (name2) are the same person
+func (tools *NamrSorTools) processJapaneseMatch(names []namsorapi.MatchPersonalFirstLastNameIn) (map[string]namsorapi.NameMatchedOut, error) {
+	result := map[string]namsorapi.NameMatchedOut{}
+	data := namsorapi.BatchMatchPersonalFirstLastNameIn{
+		PersonalNames: names,
+	}
+	matched := namsorapi.BatchNameMatchedOut{}
+	// the SDK only accepts a BatchFirstLastNameIn for this endpoint
+	err := tools.callApi("POST", "/api2/json/japaneseNameMatchBatch", data, &matched)
+	if err != nil {
+		return nil, err
+	}
+	for _, matchedName := range matched.MatchedNames {
+		result[matchedName.Id] = matchedName
+	}
+	return result, nil
+}
+
+// processParsedNames parses full names, to call the services that only accept first / last names
+func (tools *NamrSorTools) processParsedNames(names []namsorapi.PersonalNameIn) ([]namsorapi.FirstLastNameIn, error) {
+	parseds, err := tools.processParse(names)
+	if err != nil {
+		return nil, err
+	}
+	var firstLastNames []namsorapi.FirstLastNameIn
+	for _, name := range names {
+		parsed := parseds[name.Id]
+		tools.parsedNames[name.Id] = parsed
+		firstLastNames = append(firstLastNames, namsorapi.FirstLastNameIn{
+			Id:        name.Id,
+			FirstName: parsed.FirstLastName.FirstName,
+			LastName:  parsed.FirstLastName.LastName,
+		})
+	}
+	return firstLastNames, nil
+}
+
+// processParsedNamesGeo parses full names with their geographic context, to call the services that only accept first / last names
+func (tools *NamrSorTools) processParsedNamesGeo(names []namsorapi.PersonalNameGeoIn) ([]namsorapi.FirstLastNameGeoIn, error) {
+	parseds, err := tools.processParseGeo(names)
+	if err != nil {
+		return nil, err
+	}
+	var firstLastNames []namsorapi.FirstLastNameGeoIn
+	for _, name := range names {
+		parsed := parseds[name.Id]
+		tools.parsedNames[name.Id] = parsed
+		firstLastNames = append(firstLastNames, namsorapi.FirstLastNameGeoIn{
+			Id:          name.Id,
+			FirstName:   parsed.FirstLastName.FirstName,
+			LastName:    parsed.FirstLastName.LastName,
+			CountryIso2: name.CountryIso2,
+		})
+	}
+	return firstLastNames, nil
+}
+
+// withGeo adds a geographic context to first / last names
+func withGeo(names []namsorapi.FirstLastNameIn, countryIso2 string) []namsorapi.FirstLastNameGeoIn {
+	var namesGeo []namsorapi.FirstLastNameGeoIn
+	for _, name := range names {
+		namesGeo = append(namesGeo, namsorapi.FirstLastNameGeoIn{
+			Id:          name.Id,
+			FirstName:   name.FirstName,
+			LastName:    name.LastName,
+			CountryIso2: countryIso2,
+		})
+	}
+	return namesGeo
+}
+
 func (tools *NamrSorTools) processUSRaceEthnicity(names []namsorapi.FirstLastNameGeoIn) (map[string]namsorapi.FirstLastNameUsRaceEthnicityOut, error) {
 	result := map[string]namsorapi.FirstLastNameUsRaceEthnicityOut{}
 	data := namsorapi.BatchFirstLastNameGeoIn{
@@ -620,6 +1537,24 @@ func (tools *NamrSorTools) processUSRaceEthnicity(names []namsorapi.FirstLastNam
 	return result, nil
 }
 
+func (tools *NamrSorTools) processUSZipRaceEthnicity(names []namsorapi.FirstLastNameGeoZippedIn) (map[string]namsorapi.FirstLastNameUsRaceEthnicityOut, error) {
+	result := map[string]namsorapi.FirstLastNameUsRaceEthnicityOut{}
+	data := namsorapi.BatchFirstLastNameGeoZippedIn{
+		PersonalNames: names,
+	}
+	body := namsorapi.UsZipRaceEthnicityBatchOpts{
+		BatchFirstLastNameGeoZippedIn: optional.NewInterface(data),
+	}
+	racedEthnicized, _, err := tools.personalApi.UsZipRaceEthnicityBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range racedEthnicized.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
 func (tools *NamrSorTools) processPhoneCode(names []namsorapi.FirstLastNamePhoneNumberIn) (map[string]namsorapi.FirstLastNamePhoneCodedOut, error) {
 	result := map[string]namsorapi.FirstLastNamePhoneCodedOut{}
 	data := namsorapi.BatchFirstLastNamePhoneNumberIn{
@@ -643,7 +1578,6 @@ func (tools *NamrSorTools) processPhoneCode(names []namsorapi.FirstLastNamePhone
 */
 func (tools *NamrSorTools) processData(service string, outputHeaders []string, writer *bufio.Writer, flushBuffers bool, softwareNameAndVersion string) error {
 	if flushBuffers && len(tools.firstLastNamesIn) != 0 || len(tools.firstLastNamesIn) >= BATCH_SIZE {
-		var err error = nil
 		inpType := reflect.TypeOf(namsorapi.FirstLastNameIn{})
 		values := []namsorapi.FirstLastNameIn{}
 		for _, v := range tools.firstLastNamesIn {
@@ -654,120 +1588,322 @@ func (tools *NamrSorTools) processData(service string, outputHeaders []string, w
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion)
-		} else if service == SERVICE_NAME_GENDER {
-			genders, err := tools.processGender(values)
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == SERVICE_NAME_GENDER {
+			genders, err := tools.processGender(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == SERVICE_NAME_COUNTRY {
+			countrieds, err := tools.processCountryAdapted(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == SERVICE_NAME_CHINESE_GENDER {
+			genders, err := tools.processChineseGenderPinyin(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == SERVICE_NAME_JAPANESE_LATIN {
+			candidates, err := tools.processJapaneseLatin(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, candidates, reflect.TypeOf(namsorapi.NameMatchCandidatesOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == SERVICE_NAME_JAPANESE_KANJI {
+			candidates, err := tools.processJapaneseKanji(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, candidates, reflect.TypeOf(namsorapi.NameMatchCandidatesOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.firstLastNamesIn = make(map[string]namsorapi.FirstLastNameIn)
+	}
+	if flushBuffers && len(tools.firstLastNamesGeoIn) != 0 || len(tools.firstLastNamesGeoIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.FirstLastNameGeoIn{})
+		values := []namsorapi.FirstLastNameGeoIn{}
+		for _, v := range tools.firstLastNamesGeoIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_ORIGIN) {
+			origins, err := tools.processOrigin(withoutGeo(values))
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_COUNTRY) {
+			countrieds, err := tools.processCountryGeoAdapted(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_GENDER) {
+			genders, err := tools.processGenderGeo(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_DIASPORA) {
+			diasporas, err := tools.processDiaspora(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, diasporas, reflect.TypeOf(namsorapi.FirstLastNameDiasporaedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_USRACEETHNICITY) {
+			usRaceEthnicities, err := tools.processUSRaceEthnicity(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, usRaceEthnicities, reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_CASTEGROUP) {
+			castegroups, err := tools.processCastegroup(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, castegroups, reflect.TypeOf(castegroupedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_RELIGION) {
+			religions, err := tools.processReligion(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, religions, reflect.TypeOf(religionedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.firstLastNamesGeoIn = make(map[string]namsorapi.FirstLastNameGeoIn)
+	}
+	if flushBuffers && len(tools.personalNamesIn) != 0 || len(tools.personalNamesIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.PersonalNameIn{})
+		values := []namsorapi.PersonalNameIn{}
+		for _, v := range tools.personalNamesIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_PARSE) {
+			parseds, err := tools.processParse(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, parseds, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_GENDER) && tools.isParseFirst() {
+			firstLastNames, err := tools.processParsedNames(values)
+			if err != nil {
+				return err
+			}
+			genders, err := tools.processGender(firstLastNames)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_GENDER) {
+			genders, err := tools.processGenderFull(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, genders, reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_COUNTRY) {
+			countrieds, err := tools.processCountry(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_ORIGIN) {
+			firstLastNames, err := tools.processParsedNames(values)
+			if err != nil {
+				return err
+			}
+			origins, err := tools.processOrigin(firstLastNames)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_DIASPORA) {
+			firstLastNames, err := tools.processParsedNames(values)
+			if err != nil {
+				return err
+			}
+			diasporas, err := tools.processDiaspora(withGeo(firstLastNames, tools.getConfig().CountryIso2))
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, diasporas, reflect.TypeOf(namsorapi.FirstLastNameDiasporaedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_USRACEETHNICITY) {
+			firstLastNames, err := tools.processParsedNames(values)
+			if err != nil {
+				return err
+			}
+			usRaceEthnicities, err := tools.processUSRaceEthnicity(withGeo(firstLastNames, "US"))
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, usRaceEthnicities, reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_CHINESE_PARSE) {
+			parseds, err := tools.processChineseParse(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, parseds, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_CHINESE_PINYIN) {
+			pinyins, err := tools.processChinesePinyin(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, pinyins, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_CHINESE_GENDER) {
+			genders, err := tools.processChineseGender(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, genders, reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.personalNamesIn = make(map[string]namsorapi.PersonalNameIn)
+		tools.parsedNames = make(map[string]namsorapi.PersonalNameParsedOut)
+	}
+	if flushBuffers && len(tools.personalNamesGeoIn) != 0 || len(tools.personalNamesGeoIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.PersonalNameGeoIn{})
+		values := []namsorapi.PersonalNameGeoIn{}
+		for _, v := range tools.personalNamesGeoIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_PARSE) {
+			parseds, err := tools.processParseGeo(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, parseds, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_GENDER) && tools.isParseFirst() {
+			firstLastNames, err := tools.processParsedNamesGeo(values)
+			if err != nil {
+				return err
+			}
+			genders, err := tools.processGenderGeo(firstLastNames)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_GENDER) {
+			genders, err := tools.processGenderFullGeo(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, genders, reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_ORIGIN) {
+			firstLastNames, err := tools.processParsedNamesGeo(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion)
-		} else if service == SERVICE_NAME_COUNTRY {
-			countrieds, err := tools.processCountryAdapted(values)
+			origins, err := tools.processOrigin(withoutGeo(firstLastNames))
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion)
-		}
-		tools.firstLastNamesIn = make(map[string]namsorapi.FirstLastNameIn)
-		if err != nil {
-			return err
-		}
-	}
-	if flushBuffers && len(tools.firstLastNamesGeoIn) != 0 || len(tools.firstLastNamesGeoIn) >= BATCH_SIZE {
-		var err error = nil
-		inpType := reflect.TypeOf(namsorapi.FirstLastNameGeoIn{})
-		values := []namsorapi.FirstLastNameGeoIn{}
-		for _, v := range tools.firstLastNamesGeoIn {
-			values = append(values, v)
-		}
-		if service == (SERVICE_NAME_ORIGIN) {
-			origins, err := tools.processOriginGeo(values)
-			if err != nil {
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion); err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, origins, reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}), softwareNameAndVersion)
-		} else if service == (SERVICE_NAME_GENDER) {
-			genders, err := tools.processGenderGeo(values)
+		} else if service == (SERVICE_NAME_DIASPORA) {
+			firstLastNames, err := tools.processParsedNamesGeo(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, genders, reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}), softwareNameAndVersion)
-		} else if service == (SERVICE_NAME_DIASPORA) {
-			diasporas, err := tools.processDiaspora(values)
+			diasporas, err := tools.processDiaspora(firstLastNames)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, diasporas, reflect.TypeOf(namsorapi.FirstLastNameDiasporaedOut{}), softwareNameAndVersion)
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, diasporas, reflect.TypeOf(namsorapi.FirstLastNameDiasporaedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
 		} else if service == (SERVICE_NAME_USRACEETHNICITY) {
-			usRaceEthnicities, err := tools.processUSRaceEthnicity(values)
+			firstLastNames, err := tools.processParsedNamesGeo(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoIn, inpType, usRaceEthnicities, reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}), softwareNameAndVersion)
-		}
-		tools.firstLastNamesGeoIn = make(map[string]namsorapi.FirstLastNameGeoIn)
-		if err != nil {
-			return err
-		}
-	}
-	if flushBuffers && len(tools.personalNamesIn) != 0 || len(tools.personalNamesIn) >= BATCH_SIZE {
-		var err error = nil
-		inpType := reflect.TypeOf(namsorapi.PersonalNameIn{})
-		values := []namsorapi.PersonalNameIn{}
-		for _, v := range tools.personalNamesIn {
-			values = append(values, v)
-		}
-		if service == (SERVICE_NAME_PARSE) {
-			parseds, err := tools.processParse(values)
+			usRaceEthnicities, err := tools.processUSRaceEthnicity(firstLastNames)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, parseds, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion)
-		} else if service == (SERVICE_NAME_GENDER) {
-			genders, err := tools.processGenderFull(values)
-			if err != nil {
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, usRaceEthnicities, reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}), softwareNameAndVersion); err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, genders, reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}), softwareNameAndVersion)
 		} else if service == (SERVICE_NAME_COUNTRY) {
-			countrieds, err := tools.processCountry(values)
+			countrieds, err := tools.processCountryGeo(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.personalNamesIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion)
-		}
-		tools.personalNamesIn = make(map[string]namsorapi.PersonalNameIn)
-		if err != nil {
-			return err
-		}
-	}
-	if flushBuffers && len(tools.personalNamesGeoIn) != 0 || len(tools.personalNamesGeoIn) >= BATCH_SIZE {
-		var err error = nil
-		inpType := reflect.TypeOf(namsorapi.PersonalNameGeoIn{})
-		values := []namsorapi.PersonalNameGeoIn{}
-		for _, v := range tools.personalNamesGeoIn {
-			values = append(values, v)
-		}
-		if service == (SERVICE_NAME_PARSE) {
-			parseds, err := tools.processParseGeo(values)
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, countrieds, reflect.TypeOf(namsorapi.PersonalNameGeoOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_CASTEGROUP) {
+			castegroups, err := tools.processCastegroupFull(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, parseds, reflect.TypeOf(namsorapi.PersonalNameParsedOut{}), softwareNameAndVersion)
-		} else if service == (SERVICE_NAME_GENDER) {
-			genders, err := tools.processGenderFullGeo(values)
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, castegroups, reflect.TypeOf(castegroupedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		} else if service == (SERVICE_NAME_RELIGION) {
+			religions, err := tools.processReligionFull(values)
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, genders, reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}), softwareNameAndVersion)
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesGeoIn, inpType, religions, reflect.TypeOf(religionedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
 		}
 		tools.personalNamesGeoIn = make(map[string]namsorapi.PersonalNameGeoIn)
-		if err != nil {
-			return err
-		}
+		tools.parsedNames = make(map[string]namsorapi.PersonalNameParsedOut)
 	}
 	if flushBuffers && len(tools.firstLastNamesPhoneNumberIn) != 0 || len(tools.firstLastNamesPhoneNumberIn) >= BATCH_SIZE {
-		var err error = nil
 		inpType := reflect.TypeOf(namsorapi.FirstLastNamePhoneNumberIn{})
 		values := []namsorapi.FirstLastNamePhoneNumberIn{}
 		for _, v := range tools.firstLastNamesPhoneNumberIn {
@@ -778,12 +1914,79 @@ func (tools *NamrSorTools) processData(service string, outputHeaders []string, w
 			if err != nil {
 				return err
 			}
-			err = tools.appendX(writer, outputHeaders, tools.firstLastNamesPhoneNumberIn, inpType, phoneCodes, reflect.TypeOf(namsorapi.FirstLastNamePhoneCodedOut{}), softwareNameAndVersion)
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesPhoneNumberIn, inpType, phoneCodes, reflect.TypeOf(namsorapi.FirstLastNamePhoneCodedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
 		}
 		tools.firstLastNamesPhoneNumberIn = make(map[string]namsorapi.FirstLastNamePhoneNumberIn)
-		if err != nil {
-			return err
+	}
+	if flushBuffers && len(tools.personalNamesPhoneNumberIn) != 0 || len(tools.personalNamesPhoneNumberIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(personalNamePhoneNumberIn{})
+		values := []personalNamePhoneNumberIn{}
+		for _, v := range tools.personalNamesPhoneNumberIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_PHONECODE) {
+			phoneCodes, err := tools.processPhoneCodeFull(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.personalNamesPhoneNumberIn, inpType, phoneCodes, reflect.TypeOf(namsorapi.FirstLastNamePhoneCodedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.personalNamesPhoneNumberIn = make(map[string]personalNamePhoneNumberIn)
+	}
+	if flushBuffers && len(tools.firstLastNamesPhoneGeoIn) != 0 || len(tools.firstLastNamesPhoneGeoIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.FirstLastNamePhoneNumberGeoIn{})
+		values := []namsorapi.FirstLastNamePhoneNumberGeoIn{}
+		for _, v := range tools.firstLastNamesPhoneGeoIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_PHONECODE) {
+			phoneCodes, err := tools.processPhoneCodeGeo(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesPhoneGeoIn, inpType, phoneCodes, reflect.TypeOf(namsorapi.FirstLastNamePhoneCodedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.firstLastNamesPhoneGeoIn = make(map[string]namsorapi.FirstLastNamePhoneNumberGeoIn)
+	}
+	if flushBuffers && len(tools.firstLastNamesGeoZippedIn) != 0 || len(tools.firstLastNamesGeoZippedIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.FirstLastNameGeoZippedIn{})
+		values := []namsorapi.FirstLastNameGeoZippedIn{}
+		for _, v := range tools.firstLastNamesGeoZippedIn {
+			values = append(values, v)
+		}
+		if service == (SERVICE_NAME_USRACEETHNICITY) {
+			usRaceEthnicities, err := tools.processUSZipRaceEthnicity(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.firstLastNamesGeoZippedIn, inpType, usRaceEthnicities, reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.firstLastNamesGeoZippedIn = make(map[string]namsorapi.FirstLastNameGeoZippedIn)
+	}
+	if flushBuffers && len(tools.matchPersonalNamesIn) != 0 || len(tools.matchPersonalNamesIn) >= BATCH_SIZE {
+		inpType := reflect.TypeOf(namsorapi.MatchPersonalFirstLastNameIn{})
+		values := []namsorapi.MatchPersonalFirstLastNameIn{}
+		for _, v := range tools.matchPersonalNamesIn {
+			values = append(values, v)
 		}
+		if service == (SERVICE_NAME_JAPANESE_MATCH) {
+			matches, err := tools.processJapaneseMatch(values)
+			if err != nil {
+				return err
+			}
+			if err := tools.appendX(writer, outputHeaders, tools.matchPersonalNamesIn, inpType, matches, reflect.TypeOf(namsorapi.NameMatchedOut{}), softwareNameAndVersion); err != nil {
+				return err
+			}
+		}
+		tools.matchPersonalNamesIn = make(map[string]namsorapi.MatchPersonalFirstLastNameIn)
 	}
 	return nil
 }
@@ -791,38 +1994,75 @@ func (tools *NamrSorTools) processData(service string, outputHeaders []string, w
 /*
 	Data processing
 */
-func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer *bufio.Writer, softwareNameAndVersion string) error {
-	var lineId = 0
-	inputDataFormat = tools.getCommandLineOptions()["inputDataFormat"].(string)
-	var inputHeaders []string = nil
+func (tools *NamrSorTools) inputHeadersFor(inputDataFormat string) ([]string, error) {
 	for i, val := range INPUT_DATA_FORMAT {
 		if val == inputDataFormat {
-			inputHeaders = INPUT_DATA_FORMAT_HEADER[i]
-			print(inputHeaders)
-			print("\n")
-			break
+			if tools.isKnownOrigin() {
+				if !isPhoneFormat(inputDataFormat) {
+					return nil, errors.New("--known-origin is only for the phone formats " + INPUT_DATA_FORMAT_FNLNPHONE + " / " + INPUT_DATA_FORMAT_FULLNAMEPHONE + " / " + INPUT_DATA_FORMAT_FNLNPHONEGEO)
+				}
+				return tools.withGroupHeader(append(append([]string{}, INPUT_DATA_FORMAT_HEADER[i]...), PHONE_KNOWN_ORIGIN_HEADER)), nil
+			}
+			return tools.withGroupHeader(INPUT_DATA_FORMAT_HEADER[i]), nil
 		}
 	}
-	if inputHeaders == nil {
-		return errors.New("Invalid inputFileFormat " + inputDataFormat)
-	}
-	var outputHeaders []string = nil
+	return nil, errors.New("Invalid inputFileFormat " + inputDataFormat)
+}
+
+// isGeoFormat tells the input formats with a geographic context column, which may default to --countryIso2
+func isGeoFormat(inputDataFormat string) bool {
+	return inputDataFormat == INPUT_DATA_FORMAT_FNLNGEO || inputDataFormat == INPUT_DATA_FORMAT_FULLNAMEGEO || inputDataFormat == INPUT_DATA_FORMAT_FNLNPHONEGEO
+}
+
+func (tools *NamrSorTools) outputHeadersFor(service string) ([]string, error) {
 	for i, val := range SERVICES {
 		if val == service {
-			outputHeaders = OUTPUT_DATA_HEADERS[i]
-			break
+			outputHeaders := OUTPUT_DATA_HEADERS[i]
+			if tools.isThresholded() {
+				outputHeaders = append(append([]string{}, outputHeaders...), thresholdHeaders(OUTPUT_DATA_HEADERS[i])...)
+			}
+			if tools.isParseFirst() {
+				outputHeaders = append(append([]string{}, OUTPUT_DATA_PARSE_FIRST_HEADER...), outputHeaders...)
+			}
+			if isGeoFormat(tools.getConfig().InputDataFormat) {
+				outputHeaders = append(append([]string{}, outputHeaders...), OUTPUT_DATA_GEO_CONTEXT_HEADER...)
+			}
+			return outputHeaders, nil
+		}
+	}
+	return nil, errors.New("Invalid service " + service)
+}
+
+func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer *bufio.Writer, softwareNameAndVersion string, summary *fileSummary) error {
+	var lineId = 0
+	inputDataFormat := tools.getConfig().InputDataFormat
+	inputHeaders, err := tools.inputHeadersFor(inputDataFormat)
+	if err != nil {
+		return err
+	}
+	outputHeaders, err := tools.outputHeadersFor(service)
+	if err != nil {
+		return err
+	}
+	if tools.isParseFirst() {
+		if inputDataFormat != INPUT_DATA_FORMAT_FULLNAME && inputDataFormat != INPUT_DATA_FORMAT_FULLNAMEGEO {
+			return errors.New("--parse-first requires full names, with -f " + INPUT_DATA_FORMAT_FULLNAME + " or " + INPUT_DATA_FORMAT_FULLNAMEGEO)
+		}
+		if !contains(PARSE_FIRST_SERVICES, service) {
+			return errors.New("--parse-first is only for services " + strings.Join(PARSE_FIRST_SERVICES, " / "))
 		}
 	}
-	if outputHeaders == nil {
-		return errors.New("Invalid service " + service)
+	if _, err := serviceRoute(service, inputDataFormat, tools.isParseFirst()); err != nil {
+		return err
 	}
-	var appendHeader bool = tools.getCommandLineOptions()["header"].(bool)
-	if appendHeader && !tools.isRecover() || (tools.isRecover() && len(tools.done) == 0) {
+	var appendHeader bool = tools.getConfig().Header
+	if !tools.headerWritten && !tools.isGroupBy() && (appendHeader && !tools.isRecover() || (tools.isRecover() && len(tools.done) == 0)) {
 		// don't append a header to an existing file
 		err := tools.appendHeader(writer, inputHeaders, outputHeaders)
 		if err != nil {
 			return err
 		}
+		tools.headerWritten = true
 	}
 	var dataLenExpected = len(inputHeaders)
 	dataFormatExpected := ""
@@ -830,7 +2070,7 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 		dataLenExpected += 1
 		dataFormatExpected += "uid" + tools.separatorIn
 	}
-	countryIso2Default := tools.getCommandLineOptions()["countryIso2"].(string)
+	countryIso2Default := tools.getConfig().CountryIso2
 
 	for i, val := range inputHeaders {
 		dataFormatExpected += val
@@ -850,9 +2090,11 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 				line = line + " "
 			}
 			lineData := strings.Split(line, "|")
+			summary.rowsRead++
 			if len(lineData) != dataLenExpected {
 				if tools.skipErrors {
-					logger.Warn("Line " + strconv.Itoa(lineId) + ", expected input with format : " + dataFormatExpected + " line = " + line)
+					summary.rowsSkipped++
+					logger.WithFields(recordFields(lineId, LOG_REASON_COLUMN_COUNT, line)).Warn("Line " + strconv.Itoa(lineId) + ", expected input with format : " + dataFormatExpected)
 					lineId++
 					line, err = reader.ReadString('\n')
 					if err != nil && err != io.EOF {
@@ -861,7 +2103,7 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 					line = strings.TrimRight(line, "\r\n")
 					continue
 				} else {
-					return errors.New("Line " + strconv.Itoa(lineId) + ", expected input with format : " + dataFormatExpected + " line = " + line)
+					return recordError{line: lineId, reason: LOG_REASON_COLUMN_COUNT, message: "expected input with format : " + dataFormatExpected, content: line}
 				}
 			}
 			var uId string = ""
@@ -873,8 +2115,20 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 				uId = "uid" + strconv.Itoa(uidGen)
 				uidGen += 1
 			}
-			if tools.isRecover() && contains(tools.done, uId) {
+			if tools.isGroupBy() {
+				tools.rowGroups[uId] = strings.TrimSpace(lineData[len(lineData)-1])
+			}
+			done := false
+			if tools.isRecover() {
+				doneUId, err := tools.digestText(DIGEST_COLUMN_UID, uId)
+				if err != nil {
+					return err
+				}
+				done = tools.done[tools.doneKey(doneUId, tools.sourceFile)]
+			}
+			if done {
 				// skip this, as it's already done
+				summary.rowsSkipped++
 			} else {
 				if inputDataFormat == (INPUT_DATA_FORMAT_FNLN) {
 					firstName := lineData[col]
@@ -894,8 +2148,10 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 					col += 1
 					countryIso2 := lineData[col]
 					col += 1
+					tools.geoDefaulted[uId] = false
 					if (strings.Trim(countryIso2, " ") == "") && countryIso2Default != "" {
 						countryIso2 = countryIso2Default
+						tools.geoDefaulted[uId] = true
 					}
 					firstLastNameGeoIn := namsorapi.FirstLastNameGeoIn{
 						uId,
@@ -917,8 +2173,10 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 					col += 1
 					countryIso2 := lineData[col]
 					col += 1
+					tools.geoDefaulted[uId] = false
 					if (strings.Trim(countryIso2, " ") == "") && countryIso2Default != "" {
 						countryIso2 = countryIso2Default
+						tools.geoDefaulted[uId] = true
 					}
 					personalNameGeoIn := namsorapi.PersonalNameGeoIn{
 						uId,
@@ -933,15 +2191,107 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 					col += 1
 					phoneNumber := lineData[col]
 					col += 1
+					origin := namsorapi.FirstLastNameOriginedOut{}
+					if tools.isKnownOrigin() {
+						origin = knownOriginOf(lineData[col])
+						col += 1
+					}
 					firstLastNamePhoneNumberIn := namsorapi.FirstLastNamePhoneNumberIn{
-						uId,
-						firstName,
-						lastName,
-						phoneNumber,
-						namsorapi.FirstLastNameOriginedOut{},
+						Id:                       uId,
+						FirstName:                firstName,
+						LastName:                 lastName,
+						PhoneNumber:              phoneNumber,
+						FirstLastNameOriginedOut: origin,
 					}
 
 					tools.firstLastNamesPhoneNumberIn[uId] = firstLastNamePhoneNumberIn
+				} else if inputDataFormat == (INPUT_DATA_FORMAT_FULLNAMEPHONE) {
+					fullName := lineData[col]
+					col += 1
+					phoneNumber := lineData[col]
+					col += 1
+					origin := namsorapi.FirstLastNameOriginedOut{}
+					if tools.isKnownOrigin() {
+						origin = knownOriginOf(lineData[col])
+						col += 1
+					}
+					tools.personalNamesPhoneNumberIn[uId] = personalNamePhoneNumberIn{
+						Id:                       uId,
+						Name:                     fullName,
+						PhoneNumber:              phoneNumber,
+						FirstLastNameOriginedOut: origin,
+					}
+				} else if inputDataFormat == (INPUT_DATA_FORMAT_FNLNPHONEGEO) {
+					firstName := lineData[col]
+					col += 1
+					lastName := lineData[col]
+					col += 1
+					phoneNumber := lineData[col]
+					col += 1
+					countryIso2 := lineData[col]
+					col += 1
+					tools.geoDefaulted[uId] = false
+					if (strings.Trim(countryIso2, " ") == "") && countryIso2Default != "" {
+						countryIso2 = countryIso2Default
+						tools.geoDefaulted[uId] = true
+					}
+					origin := namsorapi.FirstLastNameOriginedOut{}
+					if tools.isKnownOrigin() {
+						origin = knownOriginOf(lineData[col])
+						col += 1
+					}
+					tools.firstLastNamesPhoneGeoIn[uId] = namsorapi.FirstLastNamePhoneNumberGeoIn{
+						Id:                       uId,
+						FirstName:                firstName,
+						LastName:                 lastName,
+						PhoneNumber:              phoneNumber,
+						FirstLastNameOriginedOut: origin,
+						CountryIso2:              countryIso2,
+					}
+				} else if inputDataFormat == (INPUT_DATA_FORMAT_FNLNZIP) {
+					firstName := lineData[col]
+					col += 1
+					lastName := lineData[col]
+					col += 1
+					countryIso2 := lineData[col]
+					col += 1
+					zip5 := lineData[col]
+					col += 1
+					if strings.Trim(countryIso2, " ") == "" {
+						// ZIP5 codes are US only
+						countryIso2 = "US"
+						if countryIso2Default != "" {
+							countryIso2 = countryIso2Default
+						}
+					}
+					firstLastNameGeoZippedIn := namsorapi.FirstLastNameGeoZippedIn{
+						Id:          uId,
+						FirstName:   firstName,
+						LastName:    lastName,
+						CountryIso2: countryIso2,
+						ZipCode:     zip5,
+					}
+					tools.firstLastNamesGeoZippedIn[uId] = firstLastNameGeoZippedIn
+				} else if inputDataFormat == (INPUT_DATA_FORMAT_FNLNNAME) {
+					firstName := lineData[col]
+					col += 1
+					lastName := lineData[col]
+					col += 1
+					fullName := lineData[col]
+					col += 1
+					matchPersonalNameIn := namsorapi.MatchPersonalFirstLastNameIn{
+						Id: uId,
+						Name1: namsorapi.FirstLastNameIn{
+							Id:        uId,
+							FirstName: firstName,
+							LastName:  lastName,
+						},
+						Name2: namsorapi.PersonalNameIn{
+							Id:   uId,
+							Name: fullName,
+						},
+					}
+					tools.matchPersonalNamesIn[uId] = matchPersonalNameIn
 				}
 				err := tools.processData(service, outputHeaders, writer, false, softwareNameAndVersion)
 				if err != nil {
@@ -957,6 +2307,9 @@ func (tools *NamrSorTools) process(service string, reader *bufio.Reader, writer
 		line = strings.TrimRight(line, "\r\n")
 	}
 	err = tools.processData(service, outputHeaders, writer, true, softwareNameAndVersion)
+	if err != nil {
+		return err
+	}
 	err = writer.Flush()
 	if err != nil {
 		return err
@@ -970,27 +2323,27 @@ func (tools *NamrSorTools) appendHeader(writer *bufio.Writer, inputHeaders []str
 	for _, inputHeader := range inputHeaders {
 		_, err := writer.WriteString(inputHeader + tools.separatorOut)
 		if err != nil {
-			logger.Fatal(err.Error())
 			return errors.New(err.Error())
 		}
 	}
 	for _, outputHeader := range outputHeaders {
 		_, err := writer.WriteString(outputHeader + tools.separatorOut)
 		if err != nil {
-			logger.Fatal(err.Error())
 			return errors.New(err.Error())
 		}
 	}
 
 	_, err = writer.WriteString("version" + tools.separatorOut)
 	if err != nil {
-		logger.Fatal(err.Error())
 		return errors.New(err.Error())
 	}
 
-	_, err = writer.WriteString("rowId" + "\n")
+	if tools.isMerge() {
+		_, err = writer.WriteString("rowId" + tools.separatorOut + "sourceFile" + "\n")
+	} else {
+		_, err = writer.WriteString("rowId" + "\n")
+	}
 	if err != nil {
-		logger.Fatal(err.Error())
 		return errors.New(err.Error())
 	}
 
@@ -1007,69 +2360,141 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 	outputMap := reflect.ValueOf(output)
 	if inputMap.Kind() == reflect.Map && outputMap.Kind() == reflect.Map {
 		separatorOut := tools.separatorOut
+		// the first vault error of a row, returned before the row is complete
+		var digestErr error
+		digestText := func(column string, inClear string) string {
+			digested, err := tools.digestText(column, inClear)
+			if err != nil && digestErr == nil {
+				digestErr = err
+			}
+			return digested
+		}
 		for _, key := range inputMap.MapKeys() {
 			uid := key.Interface().(string)
 			flushedUID[uid] = true
-			_, err := writer.WriteString(uid + separatorOut)
+			if tools.isGroupBy() {
+				// only the aggregates of the groups are written, at the end of the output
+				rowsSent++
+				tools.aggregate(uid, outputMap.MapIndex(key), output != nil)
+				rowId++
+				continue
+			}
+			_, err := writer.WriteString(digestText(DIGEST_COLUMN_UID, uid) + separatorOut)
 			if err != nil {
-				logger.Fatal(err.Error())
 				return errors.New(err.Error())
 			}
 
 			inputObject := inputMap.MapIndex(key)
 			outputObject := outputMap.MapIndex(key)
+			rowsSent++
 
 			switch inpType {
 			case reflect.TypeOf(namsorapi.FirstLastNameIn{}):
 				firstLastNameIn := inputObject.Interface().(namsorapi.FirstLastNameIn)
-				_, err = writer.WriteString(tools.digestText(firstLastNameIn.FirstName) + separatorOut + tools.digestText(firstLastNameIn.LastName) + separatorOut)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, firstLastNameIn.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, firstLastNameIn.LastName) + separatorOut)
 				if err != nil {
-					logger.Fatal(err.Error())
 					return errors.New(err.Error())
 				}
 				break
 			case reflect.TypeOf(namsorapi.FirstLastNameGeoIn{}):
 				firstLastNameGeoIn := inputObject.Interface().(namsorapi.FirstLastNameGeoIn)
-				_, err = writer.WriteString(tools.digestText(firstLastNameGeoIn.FirstName) + separatorOut + tools.digestText(firstLastNameGeoIn.LastName) + separatorOut + firstLastNameGeoIn.CountryIso2 + separatorOut)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, firstLastNameGeoIn.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, firstLastNameGeoIn.LastName) + separatorOut + firstLastNameGeoIn.CountryIso2 + separatorOut)
 				if err != nil {
-					logger.Fatal(err.Error())
 					return errors.New(err.Error())
 				}
 				break
 			case reflect.TypeOf(namsorapi.PersonalNameIn{}):
 				personalNameIn := inputObject.Interface().(namsorapi.PersonalNameIn)
-				_, err = writer.WriteString(tools.digestText(personalNameIn.Name) + separatorOut)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FULL_NAME, personalNameIn.Name) + separatorOut)
 				if err != nil {
-					logger.Fatal(err.Error())
 					return errors.New(err.Error())
 				}
 				break
 			case reflect.TypeOf(namsorapi.PersonalNameGeoIn{}):
 				personalNameGeoIn := inputObject.Interface().(namsorapi.PersonalNameGeoIn)
-				_, err = writer.WriteString(tools.digestText(personalNameGeoIn.Name) + separatorOut + personalNameGeoIn.CountryIso2 + separatorOut)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FULL_NAME, personalNameGeoIn.Name) + separatorOut + personalNameGeoIn.CountryIso2 + separatorOut)
+				if err != nil {
+					return errors.New(err.Error())
+				}
+				break
+			case reflect.TypeOf(namsorapi.FirstLastNameGeoZippedIn{}):
+				firstLastNameGeoZippedIn := inputObject.Interface().(namsorapi.FirstLastNameGeoZippedIn)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, firstLastNameGeoZippedIn.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, firstLastNameGeoZippedIn.LastName) + separatorOut + firstLastNameGeoZippedIn.CountryIso2 + separatorOut + firstLastNameGeoZippedIn.ZipCode + separatorOut)
+				if err != nil {
+					return errors.New(err.Error())
+				}
+				break
+			case reflect.TypeOf(namsorapi.MatchPersonalFirstLastNameIn{}):
+				matchPersonalNameIn := inputObject.Interface().(namsorapi.MatchPersonalFirstLastNameIn)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, matchPersonalNameIn.Name1.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, matchPersonalNameIn.Name1.LastName) + separatorOut + digestText(DIGEST_COLUMN_FULL_NAME, matchPersonalNameIn.Name2.Name) + separatorOut)
 				if err != nil {
-					logger.Fatal(err.Error())
 					return errors.New(err.Error())
 				}
 				break
 			case reflect.TypeOf(namsorapi.FirstLastNamePhoneNumberIn{}):
 				firstLastNamePhoneNumberIn := inputObject.Interface().(namsorapi.FirstLastNamePhoneNumberIn)
-				_, err = writer.WriteString(tools.digestText(firstLastNamePhoneNumberIn.FirstName) + separatorOut + tools.digestText(firstLastNamePhoneNumberIn.LastName) + separatorOut + tools.digestText(firstLastNamePhoneNumberIn.PhoneNumber) + separatorOut)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, firstLastNamePhoneNumberIn.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, firstLastNamePhoneNumberIn.LastName) + separatorOut + digestText(DIGEST_COLUMN_PHONE, firstLastNamePhoneNumberIn.PhoneNumber) + separatorOut)
+				if err == nil && tools.isKnownOrigin() {
+					_, err = writer.WriteString(firstLastNamePhoneNumberIn.FirstLastNameOriginedOut.CountryOrigin + separatorOut)
+				}
+				if err != nil {
+					return errors.New(err.Error())
+				}
+				break
+			case reflect.TypeOf(personalNamePhoneNumberIn{}):
+				personalNamePhoneNumber := inputObject.Interface().(personalNamePhoneNumberIn)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FULL_NAME, personalNamePhoneNumber.Name) + separatorOut + digestText(DIGEST_COLUMN_PHONE, personalNamePhoneNumber.PhoneNumber) + separatorOut)
+				if err == nil && tools.isKnownOrigin() {
+					_, err = writer.WriteString(personalNamePhoneNumber.FirstLastNameOriginedOut.CountryOrigin + separatorOut)
+				}
+				if err != nil {
+					return errors.New(err.Error())
+				}
+				break
+			case reflect.TypeOf(namsorapi.FirstLastNamePhoneNumberGeoIn{}):
+				firstLastNamePhoneNumberGeoIn := inputObject.Interface().(namsorapi.FirstLastNamePhoneNumberGeoIn)
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, firstLastNamePhoneNumberGeoIn.FirstName) + separatorOut + digestText(DIGEST_COLUMN_LAST_NAME, firstLastNamePhoneNumberGeoIn.LastName) + separatorOut + digestText(DIGEST_COLUMN_PHONE, firstLastNamePhoneNumberGeoIn.PhoneNumber) + separatorOut + firstLastNamePhoneNumberGeoIn.CountryIso2 + separatorOut)
+				if err == nil && tools.isKnownOrigin() {
+					_, err = writer.WriteString(firstLastNamePhoneNumberGeoIn.FirstLastNameOriginedOut.CountryOrigin + separatorOut)
+				}
 				if err != nil {
-					logger.Fatal(err.Error())
 					return errors.New(err.Error())
 				}
 				break
 			default:
-				logger.Fatal("Invalid input type")
 				return errors.New(fmt.Sprintf("Invalid input type : %s ", inpType.Name()))
 			}
 
-			if output == nil {
-				for i := 0; i < len(outputHeaders); i++ {
+			if tools.isParseFirst() {
+				parsed := tools.parsedNames[uid]
+				_, err = writer.WriteString(digestText(DIGEST_COLUMN_FIRST_NAME, parsed.FirstLastName.FirstName) + separatorOut +
+					digestText(DIGEST_COLUMN_LAST_NAME, parsed.FirstLastName.LastName) + separatorOut +
+					parsed.NameParserType + separatorOut +
+					parsed.NameParserTypeAlt + separatorOut +
+					fmt.Sprintf("%f", parsed.Score) + separatorOut)
+				if err != nil {
+					return errors.New(err.Error())
+				}
+			}
+
+			scriptName := ""
+			geoInput := inpType == reflect.TypeOf(namsorapi.FirstLastNameGeoIn{}) || inpType == reflect.TypeOf(namsorapi.PersonalNameGeoIn{}) || inpType == reflect.TypeOf(namsorapi.FirstLastNamePhoneNumberGeoIn{})
+			if output == nil || !outputObject.IsValid() {
+				// no answer for this row, its service columns are left empty, the parsed names and geographic context are written apart
+				rowsFailed++
+				serviceColumns := len(outputHeaders)
+				if tools.isParseFirst() {
+					serviceColumns -= len(OUTPUT_DATA_PARSE_FIRST_HEADER)
+				}
+				if geoInput {
+					serviceColumns -= len(OUTPUT_DATA_GEO_CONTEXT_HEADER)
+				}
+				if tools.isThresholded() {
+					serviceColumns -= len(thresholdHeaders(outputHeaders))
+				}
+				for i := 0; i < serviceColumns; i++ {
 					_, err = writer.WriteString("" + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 				}
@@ -1077,20 +2502,19 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 				switch outputType {
 				case reflect.TypeOf(namsorapi.FirstLastNameGenderedOut{}):
 					firstLastNameGenderedOut := outputObject.Interface().(namsorapi.FirstLastNameGenderedOut)
-					scriptName := tools.computeScriptFirst(firstLastNameGenderedOut.LastName)
+					scriptName = tools.computeScriptFirst(firstLastNameGenderedOut.LastName)
 					_, err = writer.WriteString(firstLastNameGenderedOut.LikelyGender + separatorOut +
 						fmt.Sprintf("%f", firstLastNameGenderedOut.Score) + separatorOut +
 						fmt.Sprintf("%f", firstLastNameGenderedOut.ProbabilityCalibrated) + separatorOut +
 						fmt.Sprintf("%f", firstLastNameGenderedOut.GenderScale) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.FirstLastNameOriginedOut{}):
 					firstLastNameOriginedOut := outputObject.Interface().(namsorapi.FirstLastNameOriginedOut)
-					scriptName := tools.computeScriptFirst(firstLastNameOriginedOut.LastName)
+					scriptName = tools.computeScriptFirst(firstLastNameOriginedOut.LastName)
 					_, err = writer.WriteString(firstLastNameOriginedOut.CountryOrigin + separatorOut +
 						firstLastNameOriginedOut.CountryOriginAlt + separatorOut +
 						fmt.Sprintf("%f", firstLastNameOriginedOut.ProbabilityCalibrated) + separatorOut +
@@ -1098,25 +2522,23 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 						fmt.Sprintf("%f", firstLastNameOriginedOut.Score) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.FirstLastNameDiasporaedOut{}):
 					firstLastNameDiasporaedOut := outputObject.Interface().(namsorapi.FirstLastNameDiasporaedOut)
-					scriptName := tools.computeScriptFirst(firstLastNameDiasporaedOut.LastName)
+					scriptName = tools.computeScriptFirst(firstLastNameDiasporaedOut.LastName)
 					_, err = writer.WriteString(firstLastNameDiasporaedOut.Ethnicity + separatorOut +
 						firstLastNameDiasporaedOut.EthnicityAlt + separatorOut +
 						fmt.Sprintf("%f", firstLastNameDiasporaedOut.Score) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.FirstLastNameUsRaceEthnicityOut{}):
 					firstLastNameUsRaceEthnicityOut := outputObject.Interface().(namsorapi.FirstLastNameUsRaceEthnicityOut)
-					scriptName := tools.computeScriptFirst(firstLastNameUsRaceEthnicityOut.LastName)
+					scriptName = tools.computeScriptFirst(firstLastNameUsRaceEthnicityOut.LastName)
 					_, err = writer.WriteString(firstLastNameUsRaceEthnicityOut.RaceEthnicity + separatorOut +
 						firstLastNameUsRaceEthnicityOut.RaceEthnicityAlt + separatorOut +
 						fmt.Sprintf("%f", firstLastNameUsRaceEthnicityOut.ProbabilityCalibrated) + separatorOut +
@@ -1124,25 +2546,24 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 						fmt.Sprintf("%f", firstLastNameUsRaceEthnicityOut.Score) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.PersonalNameGenderedOut{}):
 					personalNameGenderedOut := outputObject.Interface().(namsorapi.PersonalNameGenderedOut)
-					scriptName := tools.computeScriptFirst(personalNameGenderedOut.Name)
+					scriptName = tools.computeScriptFirst(personalNameGenderedOut.Name)
 					_, err = writer.WriteString(personalNameGenderedOut.LikelyGender + separatorOut +
 						fmt.Sprintf("%f", personalNameGenderedOut.Score) + separatorOut +
+						fmt.Sprintf("%f", personalNameGenderedOut.ProbabilityCalibrated) + separatorOut +
 						fmt.Sprintf("%f", personalNameGenderedOut.GenderScale) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.PersonalNameGeoOut{}):
 					personalNameGeoOut := outputObject.Interface().(namsorapi.PersonalNameGeoOut)
-					scriptName := tools.computeScriptFirst(personalNameGeoOut.Name)
+					scriptName = tools.computeScriptFirst(personalNameGeoOut.Name)
 					_, err = writer.WriteString(personalNameGeoOut.Country + separatorOut +
 						personalNameGeoOut.CountryAlt + separatorOut +
 						fmt.Sprintf("%f", personalNameGeoOut.ProbabilityCalibrated) + separatorOut +
@@ -1150,15 +2571,14 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 						fmt.Sprintf("%f", personalNameGeoOut.Score) + separatorOut +
 						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.PersonalNameParsedOut{}):
 					personalNameParsedOut := outputObject.Interface().(namsorapi.PersonalNameParsedOut)
-					firstNameParsed := personalNameParsedOut.FirstLastName.FirstName
-					lastNameParsed := personalNameParsedOut.FirstLastName.LastName
-					scriptName := tools.computeScriptFirst(personalNameParsedOut.Name)
+					firstNameParsed := digestText(DIGEST_COLUMN_FIRST_NAME, personalNameParsedOut.FirstLastName.FirstName)
+					lastNameParsed := digestText(DIGEST_COLUMN_LAST_NAME, personalNameParsedOut.FirstLastName.LastName)
+					scriptName = tools.computeScriptFirst(personalNameParsedOut.Name)
 					_, err = writer.WriteString(firstNameParsed + separatorOut +
 						lastNameParsed + separatorOut +
 						personalNameParsedOut.NameParserType + separatorOut +
@@ -1167,14 +2587,14 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 						scriptName +
 						separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
 				case reflect.TypeOf(namsorapi.FirstLastNamePhoneCodedOut{}):
 					firstLastNamePhoneCodedOut := outputObject.Interface().(namsorapi.FirstLastNamePhoneCodedOut)
-					scriptName := tools.computeScriptFirst(firstLastNamePhoneCodedOut.LastName)
-					_, err = writer.WriteString(firstLastNamePhoneCodedOut.InternationalPhoneNumberVerified + separatorOut +
+					scriptName = tools.computeScriptFirst(firstLastNamePhoneCodedOut.LastName)
+					_, err = writer.WriteString(digestText(DIGEST_COLUMN_PHONE, firstLastNamePhoneCodedOut.InternationalPhoneNumberVerified) + separatorOut +
+						digestText(DIGEST_COLUMN_PHONE, phoneNumberE164(firstLastNamePhoneCodedOut.InternationalPhoneNumberVerified)) + separatorOut +
 						firstLastNamePhoneCodedOut.PhoneCountryIso2Verified + separatorOut +
 						fmt.Sprintf("%d", firstLastNamePhoneCodedOut.PhoneCountryCode) + separatorOut +
 						fmt.Sprintf("%d", firstLastNamePhoneCodedOut.PhoneCountryCodeAlt) + separatorOut +
@@ -1184,9 +2604,58 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 						firstLastNamePhoneCodedOut.OriginCountryIso2Alt + separatorOut +
 						fmt.Sprintf("%t", firstLastNamePhoneCodedOut.Verified) + separatorOut +
 						fmt.Sprintf("%f", firstLastNamePhoneCodedOut.Score) + separatorOut +
-						scriptName)
+						scriptName + separatorOut)
+					if err != nil {
+						return errors.New(err.Error())
+					}
+					break
+				case reflect.TypeOf(namsorapi.NameMatchCandidatesOut{}):
+					nameMatchCandidatesOut := outputObject.Interface().(namsorapi.NameMatchCandidatesOut)
+					scriptName = tools.computeScriptFirst(nameMatchCandidatesOut.LastName)
+					candidates := make([]namsorapi.NameMatchCandidateOut, 2)
+					copy(candidates, nameMatchCandidatesOut.MatchCandidates)
+					_, err = writer.WriteString(digestText(DIGEST_COLUMN_FULL_NAME, candidates[0].CandidateName) + separatorOut +
+						fmt.Sprintf("%f", candidates[0].Probability) + separatorOut +
+						digestText(DIGEST_COLUMN_FULL_NAME, candidates[1].CandidateName) + separatorOut +
+						fmt.Sprintf("%f", candidates[1].Probability) + separatorOut +
+						scriptName + separatorOut)
+					if err != nil {
+						return errors.New(err.Error())
+					}
+					break
+				case reflect.TypeOf(castegroupedOut{}):
+					castegrouped := outputObject.Interface().(castegroupedOut)
+					scriptName = tools.computeScriptFirst(castegrouped.LastName + castegrouped.Name)
+					_, err = writer.WriteString(castegrouped.Castegroup + separatorOut +
+						castegrouped.CastegroupAlt + separatorOut +
+						fmt.Sprintf("%f", castegrouped.ProbabilityCalibrated) + separatorOut +
+						fmt.Sprintf("%f", castegrouped.ProbabilityAltCalibrated) + separatorOut +
+						fmt.Sprintf("%f", castegrouped.Score) + separatorOut +
+						scriptName + separatorOut)
+					if err != nil {
+						return errors.New(err.Error())
+					}
+					break
+				case reflect.TypeOf(religionedOut{}):
+					religioned := outputObject.Interface().(religionedOut)
+					scriptName = tools.computeScriptFirst(religioned.LastName + religioned.Name)
+					_, err = writer.WriteString(religioned.Religion + separatorOut +
+						religioned.ReligionAlt + separatorOut +
+						fmt.Sprintf("%f", religioned.ProbabilityCalibrated) + separatorOut +
+						fmt.Sprintf("%f", religioned.ProbabilityAltCalibrated) + separatorOut +
+						fmt.Sprintf("%f", religioned.Score) + separatorOut +
+						scriptName + separatorOut)
+					if err != nil {
+						return errors.New(err.Error())
+					}
+					break
+				case reflect.TypeOf(namsorapi.NameMatchedOut{}):
+					nameMatchedOut := outputObject.Interface().(namsorapi.NameMatchedOut)
+					scriptName = tools.computeScriptFirst(inputObject.Interface().(namsorapi.MatchPersonalFirstLastNameIn).Name2.Name)
+					_, err = writer.WriteString(nameMatchedOut.MatchStatus + separatorOut +
+						fmt.Sprintf("%f", nameMatchedOut.Score) + separatorOut +
+						scriptName + separatorOut)
 					if err != nil {
-						logger.Fatal(err.Error())
 						return errors.New(err.Error())
 					}
 					break
@@ -1194,21 +2663,62 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 					return errors.New(fmt.Sprintf("Invalid output type : %s ", outputType.Name()))
 				}
 			}
+			if output != nil && outputObject.IsValid() {
+				tools.stats.record(outputObject.Interface(), scriptName)
+			}
+			if tools.isThresholded() {
+				label, confidence := "", ""
+				if output != nil && outputObject.IsValid() {
+					label, confidence = tools.thresholded(outputObject.Interface())
+					if confidence == CONFIDENCE_UNCERTAIN {
+						rowsUncertain++
+					}
+				}
+				_, err = writer.WriteString(label + separatorOut + confidence + separatorOut)
+				if err != nil {
+					return errors.New(err.Error())
+				}
+			}
+			if geoInput {
+				geoContext := reflect.Indirect(inputObject).FieldByName("CountryIso2").String()
+				geoContextSource, geoContextUsed := "", ""
+				if tools.geoDefaulted[uid] {
+					geoContextSource = GEO_CONTEXT_SOURCE_DEFAULT
+				} else if strings.TrimSpace(geoContext) != "" {
+					geoContextSource = GEO_CONTEXT_SOURCE_INPUT
+				}
+				if geoContextSource != "" {
+					geoContextUsed = geoContextUse(tools.getConfig().Service, tools.getConfig().InputDataFormat)
+				}
+				delete(tools.geoDefaulted, uid)
+				_, err = writer.WriteString(geoContext + separatorOut + geoContextSource + separatorOut + geoContextUsed + separatorOut)
+				if err != nil {
+					return errors.New(err.Error())
+				}
+			}
+			if digestErr != nil {
+				return digestErr
+			}
 			_, err = writer.WriteString(softwareNameAndVersion + separatorOut)
-			_, err = writer.WriteString(fmt.Sprintf("%d\n", rowId))
+			if tools.isMerge() {
+				_, err = writer.WriteString(fmt.Sprintf("%d", rowId) + separatorOut + tools.sourceFile + "\n")
+			} else {
+				_, err = writer.WriteString(fmt.Sprintf("%d\n", rowId))
+			}
 			rowId++
 		}
 		err := writer.Flush()
 		if err != nil {
-			logger.Fatal(err.Error())
 			return errors.New(err.Error())
 		}
 		if tools.isRecover() {
-			keys := make([]string, 0, len(flushedUID))
 			for k := range flushedUID {
-				keys = append(keys, k)
+				doneUId, err := tools.digestText(DIGEST_COLUMN_UID, k)
+				if err != nil {
+					return err
+				}
+				tools.done[tools.doneKey(doneUId, tools.sourceFile)] = true
 			}
-			tools.done = append(tools.done, keys...)
 		}
 		if rowId%100 == 0 && rowId < 1000 ||
 			rowId%1000 == 0 && rowId < 10000 ||
@@ -1221,26 +2731,5 @@ func (tools *NamrSorTools) appendX(writer *bufio.Writer, outputHeaders []string,
 }
 
 func main() {
-	flag.StringVarP(&apiKey, "apiKey", "a", "", "NamSor API Key")
-	flag.StringVarP(&inputFile, "inputFile", "i", "", "input file name")
-	flag.StringVarP(&outputFile, "outputFile", "o", "", "output file name")
-	flag.BoolVarP(&overwrite, "overwrite", "w", false, "overwrite existing output file")
-	flag.BoolVarP(&recover, "recover", "r", false, "continue from a job (requires uid)")
-	flag.StringVarP(&inputDataFormat, "inputDataFormat", "f", "", "input data format : first name, last name (fnln) / first name, last name, geo country iso2 (fnlngeo) / full name (name) / full name, geo country iso2 (namegeo) ")
-	flag.BoolVarP(&header, "header", "h", false, "output header")
-	flag.BoolVarP(&uid, "uid", "u", false, "input data has an ID prefix")
-	flag.BoolVarP(&digest, "digest", "d", false, "SHA-256 digest names in output")
-	flag.StringVarP(&service, "service", "s", "", "service : parse / gender / origin / diaspora / usraceethnicity")
-	flag.StringVarP(&encoding, "encoding", "e", "", "encoding : UTF-8 by default")
-
-	flag.Parse()
-
-	tools := NewNamSorTools()
-	if tools == nil {
-		logger.Fatalf("No API key provided!")
-	}
-	err := tools.run()
-	if err != nil {
-		logger.Fatalf(err.Error())
-	}
+	os.Exit(execute())
 }
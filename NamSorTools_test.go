@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// routeServer answers every batch of names with a parsed, classified name, and records the endpoints called
+func routeServer(t *testing.T) (*httptest.Server, func() []string) {
+	var lock sync.Mutex
+	endpoints := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		endpoints = append(endpoints, r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+		lock.Unlock()
+		in := map[string][]map[string]interface{}{}
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+			t.Errorf("invalid request to %s: %v", r.URL.Path, err)
+		}
+		out := []map[string]interface{}{}
+		for _, names := range in {
+			for _, name := range names {
+				name["firstLastName"] = map[string]string{"firstName": "Anna", "lastName": "Smith"}
+				name["likelyGender"] = "female"
+				name["probabilityCalibrated"] = 0.65
+				out = append(out, name)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"personalNames": out, "matchedNames": out, "namesAndMatchCandidates": out, "personalNamesWithPhoneNumbers": out})
+	}))
+	return server, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, endpoints...)
+	}
+}
+
+// routeRow is an input row of a format, with a value for each column
+func routeRow(inputDataFormat string) string {
+	values := map[string]string{"countryIso2": "US", "phone": "+1 212 555 0100", "zip5": "10001", "fullName": "Anna Smith"}
+	row := "u1"
+	for i, format := range INPUT_DATA_FORMAT {
+		if format != inputDataFormat {
+			continue
+		}
+		for _, header := range INPUT_DATA_FORMAT_HEADER[i] {
+			value, ok := values[header]
+			if !ok {
+				value = "Anna"
+			}
+			row += "|" + value
+		}
+	}
+	return row + "\n"
+}
+
+func TestServiceRoutes(t *testing.T) {
+	server, called := routeServer(t)
+	defer server.Close()
+	check := func(key string, route []string, parseFirst bool) {
+		formatAndService := strings.SplitN(key, "|", 2)
+		tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: formatAndService[0], Service: formatAndService[1], CountryIso2: "US", ParseFirst: parseFirst, Uid: true})
+		tools.apiConfig.BasePath = server.URL
+		before := len(called())
+		var output bytes.Buffer
+		writer := bufio.NewWriter(&output)
+		err := tools.process(formatAndService[1], bufio.NewReader(strings.NewReader(routeRow(formatAndService[0]))), writer, "test", &fileSummary{})
+		if err != nil {
+			t.Errorf("%s, parse first %v: %v", key, parseFirst, err)
+			return
+		}
+		if endpoints := called()[before:]; !reflect.DeepEqual(endpoints, route) {
+			t.Errorf("%s, parse first %v: called %v, route %v", key, parseFirst, endpoints, route)
+		}
+	}
+	for key, route := range SERVICE_ROUTES {
+		check(key, route, false)
+	}
+	for key, route := range SERVICE_PARSE_FIRST_ROUTES {
+		check(key, route, true)
+	}
+}
+
+func TestServiceRouteUnsupported(t *testing.T) {
+	if _, err := serviceRoute(SERVICE_NAME_GENDER, INPUT_DATA_FORMAT_FNLNZIP, false); err == nil {
+		t.Error("gender of first / last names with a zip code has no route")
+	}
+	route, err := serviceRoute(SERVICE_NAME_ORIGIN, INPUT_DATA_FORMAT_FULLNAME, true)
+	if err != nil || !reflect.DeepEqual(route, SERVICE_ROUTES[INPUT_DATA_FORMAT_FULLNAME+"|"+SERVICE_NAME_ORIGIN]) {
+		t.Errorf("origin of full names with --parse-first: %v %v", route, err)
+	}
+}
+
+func TestLastBatchErrorFailsProcess(t *testing.T) {
+	server := failingServer()
+	defer server.Close()
+	tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, Uid: true})
+	tools.apiConfig.BasePath = server.URL
+	var output bytes.Buffer
+	writer := bufio.NewWriter(&output)
+	// the only batch is sent at the end of the input
+	if err := tools.process(SERVICE_NAME_GENDER, bufio.NewReader(strings.NewReader("u1|Anna|Smith\n")), writer, "test", &fileSummary{}); err == nil {
+		t.Error("an API error of the last batch doesn't fail the file")
+	}
+}
+
+func TestGeoContextUse(t *testing.T) {
+	server, _ := routeServer(t)
+	defer server.Close()
+	for _, test := range []struct {
+		inputDataFormat string
+		service         string
+		row             string
+		countryIso2     string
+		geoContext      string
+	}{
+		{INPUT_DATA_FORMAT_FNLNGEO, SERVICE_NAME_GENDER, "u1|Anna|Smith|US\n", "", "|US|input|classify|"},
+		{INPUT_DATA_FORMAT_FNLNGEO, SERVICE_NAME_ORIGIN, "u1|Anna|Smith|US\n", "", "|US|input|none|"},
+		{INPUT_DATA_FORMAT_FNLNGEO, SERVICE_NAME_COUNTRY, "u1|Anna|Smith|\n", "FR", "|FR|default|none|"},
+		{INPUT_DATA_FORMAT_FULLNAMEGEO, SERVICE_NAME_ORIGIN, "u1|Anna Smith|US\n", "", "|US|input|parse|"},
+		{INPUT_DATA_FORMAT_FULLNAMEGEO, SERVICE_NAME_COUNTRY, "u1|Anna Smith|US\n", "", "|US|input|none|"},
+	} {
+		tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: test.inputDataFormat, Service: test.service, CountryIso2: test.countryIso2, Uid: true})
+		tools.apiConfig.BasePath = server.URL
+		var output bytes.Buffer
+		writer := bufio.NewWriter(&output)
+		if err := tools.process(test.service, bufio.NewReader(strings.NewReader(test.row)), writer, "test", &fileSummary{}); err != nil {
+			t.Errorf("%s %s: %v", test.inputDataFormat, test.service, err)
+			continue
+		}
+		if !strings.Contains(output.String(), test.geoContext+"test|") {
+			t.Errorf("%s %s: %q, expected the geographic context %s", test.inputDataFormat, test.service, output.String(), test.geoContext)
+		}
+	}
+}
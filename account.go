@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	"golang.org/x/net/context"
+)
+
+const COMMAND_ACCOUNT string = "account"
+
+/*
+	Account : plan, credits, usage history and API status. The SDK decodes the usage history and the
+	status into the wrong models, these are read with callApi. The limits of the API are the soft and hard
+	credit limits of the billing period, it doesn't tell request rate limits.
+*/
+type accountCredits struct {
+	Quota     int64   `json:"quota"`
+	Used      int64   `json:"used"`
+	Remaining int64   `json:"remaining"`
+	UsedRatio float64 `json:"usedRatio"`
+	SoftLimit int64   `json:"softLimit"`
+	HardLimit int64   `json:"hardLimit"`
+	Overage   int64   `json:"overage"`
+}
+
+type accountOut struct {
+	SoftwareVersion string                             `json:"softwareVersion"`
+	Subscription    namsorapi.ApiPlanSubscriptionOut   `json:"subscription"`
+	BillingPeriod   namsorapi.ApiBillingPeriodUsageOut `json:"billingPeriod"`
+	Credits         accountCredits                     `json:"credits"`
+	UsageHistory    namsorapi.ApiUsageAggregatedOut    `json:"usageHistory"`
+	Status          namsorapi.ApiClassifiersStatusOut  `json:"status"`
+}
+
+func (tools *NamrSorTools) account() (accountOut, error) {
+	account := accountOut{}
+	softwareVersion, _, err := tools.adminApi.SoftwareVersion(context.Background())
+	if err != nil {
+		return account, err
+	}
+	account.SoftwareVersion = softwareVersion.SoftwareNameAndVersion
+	usage, _, err := tools.adminApi.ApiUsage(tools.auth)
+	if err != nil {
+		return account, err
+	}
+	// keep keys and payment ids out of the report
+	usage.Subscription.ApiKey = ""
+	usage.Subscription.StripeCustomerId = ""
+	usage.Subscription.StripeSubscription = ""
+	usage.Subscription.UserId = ""
+	usage.BillingPeriod.ApiKey = ""
+	account.Subscription = usage.Subscription
+	account.BillingPeriod = usage.BillingPeriod
+	account.Credits = accountCredits{
+		Quota:     usage.Subscription.PlanQuota,
+		Used:      usage.BillingPeriod.Usage,
+		SoftLimit: usage.BillingPeriod.SoftLimit,
+		HardLimit: usage.BillingPeriod.HardLimit,
+		Overage:   usage.OverageQuantity,
+	}
+	if account.Credits.Quota > account.Credits.Used {
+		account.Credits.Remaining = account.Credits.Quota - account.Credits.Used
+	}
+	if account.Credits.Quota > 0 {
+		account.Credits.UsedRatio = float64(account.Credits.Used) / float64(account.Credits.Quota)
+	}
+	err = tools.callApi("GET", "/api2/json/apiUsageHistoryAggregate", nil, &account.UsageHistory)
+	if err != nil {
+		return account, err
+	}
+	err = tools.callApi("GET", "/api2/json/apiStatus", nil, &account.Status)
+	if err != nil {
+		return account, err
+	}
+	return account, nil
+}
+
+func (tools *NamrSorTools) runAccount(writer io.Writer, asJson bool) error {
+	account, err := tools.account()
+	if err != nil {
+		return err
+	}
+	if asJson {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(account)
+	}
+	return writeAccount(writer, account)
+}
+
+func formatMillis(millis int64) string {
+	if millis <= 0 {
+		return "-"
+	}
+	return time.Unix(0, millis*int64(time.Millisecond)).UTC().Format("2006-01-02 15:04")
+}
+
+func writeAccount(writer io.Writer, account accountOut) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Software version\t%s\n", account.SoftwareVersion)
+	fmt.Fprintf(table, "Plan\t%s (%s)\n", account.Subscription.PlanName, account.Subscription.PlanStatus)
+	fmt.Fprintf(table, "Billing period\t%s - %s (%s)\n", formatMillis(account.BillingPeriod.PeriodStarted), formatMillis(account.BillingPeriod.PeriodEnded), account.BillingPeriod.BillingStatus)
+	fmt.Fprintf(table, "Credits\t%d used of %d, %d remaining (%.1f%%)\n", account.Credits.Used, account.Credits.Quota, account.Credits.Remaining, 100*account.Credits.UsedRatio)
+	fmt.Fprintf(table, "Credit limits\tsoft %d, hard %d per billing period\n", account.Credits.SoftLimit, account.Credits.HardLimit)
+	fmt.Fprintf(table, "Overage\t%d\n", account.Credits.Overage)
+	fmt.Fprintln(table)
+
+	history := account.UsageHistory
+	fmt.Fprintf(table, "Usage history by %s\t%s - %s, total %d\n", strings.ToLower(history.TimeUnit), formatMillis(history.PeriodStart), formatMillis(history.PeriodEnd), history.TotalUsage)
+	if len(history.ColHeaders) > 0 {
+		fmt.Fprintf(table, "\t%s\n", strings.Join(history.ColHeaders, "\t"))
+	}
+	for i, row := range history.Data {
+		rowHeader := ""
+		if i < len(history.RowHeaders) {
+			rowHeader = history.RowHeaders[i]
+		}
+		values := make([]string, len(row))
+		for j, value := range row {
+			values[j] = fmt.Sprintf("%d", value)
+		}
+		fmt.Fprintf(table, "%s\t%s\n", rowHeader, strings.Join(values, "\t"))
+	}
+	fmt.Fprintln(table)
+
+	fmt.Fprintf(table, "API status\t%s\n", account.Status.SoftwareVersion.SoftwareNameAndVersion)
+	fmt.Fprintf(table, "classifier\tserving\tlearning\tshuttingDown\n")
+	for _, classifier := range account.Status.Classifiers {
+		fmt.Fprintf(table, "%s\t%t\t%t\t%t\n", classifier.ClassifierName, classifier.Serving, classifier.Learning, classifier.ShuttingDown)
+	}
+	return table.Flush()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	"github.com/zalando/go-keyring"
+	"golang.org/x/term"
+)
+
+const COMMAND_LOGIN string = "login"
+
+// keyring service of the API keys, stored under the profile name
+const KEYRING_SERVICE string = "namsor-tools"
+
+// replaces the API key in logs and error messages
+const REDACTED string = "***"
+
+// where the API key was read from
+const (
+	API_KEY_SOURCE_OPTION  string = "option"
+	API_KEY_SOURCE_FILE    string = "file"
+	API_KEY_SOURCE_CMD     string = "command"
+	API_KEY_SOURCE_KEYRING string = "keyring"
+)
+
+var (
+	apiKeyFile string
+	apiKeyCmd  string
+)
+
+/*
+	API key sources, by order of precedence : --apiKey (or NAMSOR_API_KEY, or the apiKey of the profile), --api-key-file,
+	--api-key-cmd, then the OS keyring entry of the profile, stored with the login command.
+*/
+func resolveApiKey(options config) (string, string, error) {
+	if options.ApiKey != "" {
+		return options.ApiKey, API_KEY_SOURCE_OPTION, nil
+	}
+	if options.ApiKeyFile != "" {
+		key, err := readApiKeyFile(options.ApiKeyFile)
+		return key, API_KEY_SOURCE_FILE, err
+	}
+	if options.ApiKeyCmd != "" {
+		key, err := runApiKeyCmd(options.ApiKeyCmd)
+		return key, API_KEY_SOURCE_CMD, err
+	}
+	key, err := keyring.Get(KEYRING_SERVICE, options.Profile)
+	if err == keyring.ErrNotFound {
+		return "", "", nil
+	}
+	if err != nil {
+		// no keyring on this system, ex. a server without a desktop session
+		logger.Debugf("Can't read the keyring : %s", err.Error())
+		return "", "", nil
+	}
+	return key, API_KEY_SOURCE_KEYRING, nil
+}
+
+func readApiKeyFile(fileName string) (string, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("can't read API key file %s : %s", fileName, err.Error()))
+	}
+	if info, err := os.Stat(fileName); err == nil && info.Mode().Perm()&0077 != 0 {
+		logger.Warnf("API key file %s is readable by other users, chmod 600 %s", fileName, fileName)
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", errors.New(fmt.Sprintf("empty API key file %s", fileName))
+	}
+	return key, nil
+}
+
+// runApiKeyCmd runs a helper, ex. a password manager CLI, and reads the API key from its stdout
+func runApiKeyCmd(command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("sh", "-c", command)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("API key command failed : %s", err.Error()))
+	}
+	key := strings.TrimSpace(string(out))
+	if key == "" {
+		return "", errors.New("API key command printed no key")
+	}
+	return key, nil
+}
+
+/*
+	redactHook removes the API key from log messages and fields, which may quote requests or options.
+*/
+type redactHook struct {
+	secret string
+}
+
+func (hook redactHook) Levels() []logger.Level {
+	return logger.AllLevels
+}
+
+func (hook redactHook) Fire(entry *logger.Entry) error {
+	entry.Message = strings.ReplaceAll(entry.Message, hook.secret, REDACTED)
+	for name, value := range entry.Data {
+		if text, ok := value.(string); ok {
+			entry.Data[name] = strings.ReplaceAll(text, hook.secret, REDACTED)
+		}
+	}
+	return nil
+}
+
+// redactApiKey keeps the API key out of the logs from now on
+func redactApiKey(key string) {
+	if key != "" {
+		logger.AddHook(redactHook{secret: key})
+	}
+}
+
+// readApiKey prompts for the API key on the terminal without echo, or reads a line of stdin
+func readApiKey() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "NamSor API Key : ")
+		data, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(data)), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// runLogin checks the API key, then stores it in the OS keyring under the profile name
+func runLogin(profileName string) error {
+	key, err := readApiKey()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return newUsageError("No API key provided!")
+	}
+	redactApiKey(key)
+	options := currentConfig()
+	options.ApiKey = key
+	tools := NewNamSorTools(options)
+	_, _, err = tools.adminApi.ApiUsage(tools.auth)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't check the API key : %s", err.Error()))
+	}
+	err = keyring.Set(KEYRING_SERVICE, profileName, key)
+	if err != nil {
+		return errors.New(fmt.Sprintf("can't store the API key in the keyring : %s", err.Error()))
+	}
+	logger.Infof("API key of profile %s stored in the keyring", profileName)
+	return nil
+}
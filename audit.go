@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"time"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// results of a job in the audit log
+const (
+	AUDIT_RESULT_OK     string = "ok"
+	AUDIT_RESULT_FAILED string = "failed"
+)
+
+var auditLog string
+
+/*
+	Audit log : each enrichment job appends a JSON line to the audit log, recording who ran which command on
+	which files, with their hashes, and the outcome. The error of a failed job isn't recorded, as it may quote
+	an input line. The file is only ever opened for appending.
+*/
+type auditEntry struct {
+	At           time.Time      `json:"at"`
+	User         string         `json:"user"`
+	Host         string         `json:"host"`
+	Command      string         `json:"command"`
+	Profile      string         `json:"profile"`
+	ApiKeySource string         `json:"apiKeySource"`
+	Service      string         `json:"service"`
+	InputFile    string         `json:"inputFile"`
+	InputFiles   []manifestFile `json:"inputFiles,omitempty"`
+	OutputFiles  []manifestFile `json:"outputFiles,omitempty"`
+	Result       string         `json:"result"`
+	CreditsUsed  *int64         `json:"creditsUsed,omitempty"`
+}
+
+func defaultAuditLog() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "namsor", "audit.log")
+}
+
+// currentUserName is the OS user running the tools, empty if unknown
+func currentUserName() string {
+	current, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return current.Username
+}
+
+// command is the enrichment command of the options
+func (options config) command() string {
+	if options.Recover {
+		return COMMAND_RESUME
+	}
+	if options.Merge {
+		return COMMAND_MERGE
+	}
+	return COMMAND_ENRICH
+}
+
+// newAuditEntry records a job, with its files when it produced manifests
+func (tools *NamrSorTools) newAuditEntry(manifests []*runManifest, result string, creditsUsed *int64) auditEntry {
+	options := tools.getConfig()
+	host, _ := os.Hostname()
+	entry := auditEntry{
+		At:           time.Now().UTC(),
+		User:         currentUserName(),
+		Host:         host,
+		Command:      options.command(),
+		Profile:      options.Profile,
+		ApiKeySource: options.ApiKeySource,
+		Service:      options.Service,
+		InputFile:    options.InputFile,
+		Result:       result,
+		CreditsUsed:  creditsUsed,
+	}
+	for _, manifest := range manifests {
+		entry.InputFiles = append(entry.InputFiles, manifest.InputFiles...)
+		entry.OutputFiles = append(entry.OutputFiles, manifest.OutputFile)
+	}
+	return entry
+}
+
+// appendAuditLog appends the entry to the audit log, if any
+func appendAuditLog(fileName string, entry auditEntry) error {
+	if fileName == "" {
+		return nil
+	}
+	err := os.MkdirAll(filepath.Dir(fileName), 0700)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logger.Debugf("Job recorded in audit log %s", fileName)
+	return file.Close()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// failingServer answers every request with an error of the API
+func failingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"unavailable"}`, http.StatusServiceUnavailable)
+	}))
+}
+
+func TestAuditFailedJob(t *testing.T) {
+	server := failingServer()
+	defer server.Close()
+	auditLogName := filepath.Join(t.TempDir(), "audit.log")
+	tools := NewNamSorTools(config{ApiKey: "key1234567", InputFile: os.DevNull, InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, AuditLog: auditLogName})
+	tools.apiConfig.BasePath = server.URL
+	if err := tools.run(); err == nil {
+		t.Fatal("the job didn't fail")
+	}
+	data, err := ioutil.ReadFile(auditLogName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := auditEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Result != AUDIT_RESULT_FAILED || entry.Command != COMMAND_ENRICH || entry.Service != SERVICE_NAME_GENDER {
+		t.Errorf("audited %s", data)
+	}
+}
+
+func TestFailedFileClosesOutput(t *testing.T) {
+	server, _ := routeServer(t)
+	defer server.Close()
+	dir := t.TempDir()
+	// a batch of rows is written, then the file fails on an invalid line
+	input := ""
+	for i := 0; i < BATCH_SIZE; i++ {
+		input += fmt.Sprintf("u%d|Anna|Smith\n", i)
+	}
+	input += "invalid|Anna\n"
+	inputFileName := filepath.Join(dir, "in.txt")
+	if err := ioutil.WriteFile(inputFileName, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, Uid: true, Encoding: "UTF-8"})
+	tools.apiConfig.BasePath = server.URL
+	tools.encryption, err = parseRecipients([]string{identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputFileName := filepath.Join(dir, "out.txt"+AGE_FILE_SUFFIX)
+	if _, err := tools.runFile(SERVICE_NAME_GENDER, inputFileName, outputFileName, "test"); err == nil {
+		t.Fatal("the file didn't fail")
+	}
+	encrypted, err := os.Open(outputFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encrypted.Close()
+	decrypted, err := age.Decrypt(encrypted, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the encrypted stream is finalized, with the rows written before the error
+	rows, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		t.Fatalf("the output of a failed file isn't closed : %v", err)
+	}
+	if strings.Count(string(rows), "|Anna|Smith|") != BATCH_SIZE {
+		t.Errorf("decrypted %q", rows)
+	}
+}
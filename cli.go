@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const COMMAND_ENRICH string = "enrich"
+const COMMAND_ESTIMATE string = "estimate"
+const COMMAND_VERIFY_OUTPUT string = "verify-output"
+const COMMAND_MERGE string = "merge"
+const COMMAND_RESUME string = "resume"
+
+// exit codes of the commands
+const EXIT_OK int = 0
+const EXIT_ERROR int = 1
+const EXIT_USAGE int = 2
+const EXIT_VERIFY_FAILED int = 3
+
+// usageError is a missing or invalid argument, as opposed to a failure of the job
+type usageError struct {
+	error
+}
+
+func newUsageError(message string) error {
+	return usageError{errors.New(message)}
+}
+
+// verifyError is an output file that didn't pass verify-output
+type verifyError struct {
+	error
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return EXIT_OK
+	}
+	var usage usageError
+	if errors.As(err, &usage) || strings.HasPrefix(err.Error(), "unknown command") {
+		return EXIT_USAGE
+	}
+	var verify verifyError
+	if errors.As(err, &verify) {
+		return EXIT_VERIFY_FAILED
+	}
+	return EXIT_ERROR
+}
+
+// usageArgs reports invalid positional arguments as usage errors
+func usageArgs(args cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, arguments []string) error {
+		if err := args(cmd, arguments); err != nil {
+			return usageError{err}
+		}
+		return nil
+	}
+}
+
+func newTools(options config) (*NamrSorTools, error) {
+	key, source, err := resolveApiKey(options)
+	if err != nil {
+		return nil, err
+	}
+	redactApiKey(key)
+	options.ApiKey = key
+	options.ApiKeySource = source
+	tools := NewNamSorTools(options)
+	if tools == nil {
+		return nil, newUsageError("No API key provided! Use --apiKey, " + envName("apiKey") + ", --api-key-file, --api-key-cmd, the apiKey of a config file profile or the login command")
+	}
+	logger.Debugf("API key read from %s, options %s", source, options)
+	return tools, nil
+}
+
+func addInputFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&inputFile, "inputFile", "i", "", "input file name, directory or glob pattern, - for stdin")
+	flags.StringVarP(&inputDataFormat, "inputDataFormat", "f", "", "input data format : first name, last name (fnln) / first name, last name, geo country iso2 (fnlngeo) / full name (name) / full name, geo country iso2 (namegeo) / first name, last name, geo country iso2, US zip5 code (fnlnzip) / first name, last name, full name of the same person (fnlnname) / first name, last name, phone (fnlnphone) / full name, phone (namephone) / first name, last name, phone, declared country iso2 (fnlnphonegeo) ")
+	flags.StringVarP(&service, "service", "s", "", "service : parse / gender / origin / country / diaspora / phonecode / usraceethnicity / chineseparse / chinesepinyin / chinesegender / japaneselatin / japanesekanji / japanesematch / castegroup / religion")
+	flags.BoolVarP(&uid, "uid", "u", false, "input data has an ID prefix")
+	flags.StringVarP(&encoding, "encoding", "e", "", "encoding : UTF-8 by default")
+	flags.StringVarP(&countryIso2, "countryIso2", "c", "", "default geographic context (countryIso2) of the fnlngeo / namegeo formats, when the input has none")
+	flags.BoolVar(&parseFirst, "parse-first", false, "parse full names, then send the first and last names to the service")
+	flags.BoolVar(&knownOrigin, "known-origin", false, "phone formats : the input has a trailing countryOrigin column, the known origin of the name")
+	flags.StringVar(&sheet, "sheet", "", "Excel input : sheet name, the active sheet by default")
+	flags.IntVar(&headerRow, "headerRow", 1, "Excel input : row number of the column titles")
+	flags.StringVar(&columns, "columns", "", "Excel input : column of each input field, ex. firstName=B,lastName=Surname")
+	cmd.RegisterFlagCompletionFunc("service", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return SERVICES, cobra.ShellCompDirectiveNoFileComp
+	})
+	cmd.RegisterFlagCompletionFunc("inputDataFormat", func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		return INPUT_DATA_FORMAT[:], cobra.ShellCompDirectiveNoFileComp
+	})
+}
+
+func addOutputFlags(cmd *cobra.Command) {
+	flags := cmd.Flags()
+	flags.StringVarP(&outputFile, "outputFile", "o", "", "output file name, - for stdout")
+	flags.BoolVarP(&overwrite, "overwrite", "w", false, "overwrite existing output file")
+	flags.BoolVarP(&header, "header", "H", false, "output header")
+	flags.BoolVarP(&digest, "digest", "d", false, "pseudonymize names and phones in output, HMAC-SHA256 with a secret key")
+	flags.StringVar(&digestColumns, "digest-columns", "", "columns to pseudonymize, implies --digest : "+strings.Join(DIGEST_COLUMNS, ",")+" (default "+strings.Join(DIGEST_COLUMNS_DEFAULT, ",")+")")
+	flags.StringVar(&digestKeyFile, "digest-key-file", "", "file holding the secret key of --digest, or "+DIGEST_KEY_ENV)
+	flags.StringVar(&vaultFile, "vault", "", "pseudonymize with format-preserving tokens kept in this encrypted vault file instead of digests, implies --digest")
+	flags.StringVar(&vaultKeyFile, "vault-key-file", "", "file holding the secret key of the vault, or "+VAULT_KEY_ENV)
+	flags.StringArrayVar(&encryptTo, "encrypt-to", nil, "encrypt the output to this age recipient (age1...), age recipients file or armored OpenPGP public key file, repeatable")
+	flags.StringVar(&identity, "identity", "", "age identity file or armored OpenPGP private key, to resume an encrypted output")
+	flags.BoolVar(&anonymize, "anonymize", false, "set the API key to anonymized while processing, recorded in the .manifest.json next to the output")
+	flags.BoolVar(&noLearn, "no-learn", false, "set the API key to not learnable while processing, recorded in the .manifest.json next to the output")
+	flags.StringVar(&minProbability, "min-probability", "", "label results with a calibrated probability below this threshold unknown, ex. 0.7 or gender=0.7,origin=0.5")
+	flags.StringVar(&minScore, "min-score", "", "label results with a score below this threshold unknown, ex. 10 or diaspora=10")
+	flags.StringVar(&groupBy, "group-by", "", "the input has a trailing column of this name, ex. department : output the counts and expected counts of the labels by group instead of the rows")
+	flags.IntVar(&kAnonymity, "k-anonymity", 0, "with --group-by, suppress the groups and the counts of fewer than this number of rows")
+	flags.StringVar(&reportFile, "report", "", "write the summary statistics of the job to this .json or .html file")
+	flags.StringVar(&auditLog, "audit-log", defaultAuditLog(), "file each job is appended to, with the user, the command and the files, empty for none")
+}
+
+// newEnrichCommand runs the enrichment, as is, merged or resumed
+func newEnrichCommand(use string, short string, long string) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   use,
+		Short: short,
+		Long:  long,
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := currentConfig()
+			options.Merge = use == COMMAND_MERGE
+			options.Recover = use == COMMAND_RESUME
+			if err := options.validateInput(); err != nil {
+				return err
+			}
+			if err := options.loadThresholds(); err != nil {
+				return err
+			}
+			if err := options.loadDigest(); err != nil {
+				return err
+			}
+			setLogHashKey(options.DigestKey)
+			encryption, err := parseRecipients(options.EncryptTo)
+			if err != nil {
+				return err
+			}
+			tools, err := newTools(options)
+			if err != nil {
+				return err
+			}
+			tools.encryption = encryption
+			if options.Vault != "" {
+				tools.vault, err = openVault(options.Vault, options.VaultKey)
+				if err != nil {
+					return err
+				}
+				defer tools.vault.close()
+			}
+			return tools.run()
+		},
+	}
+	addInputFlags(cmd)
+	addOutputFlags(cmd)
+	return cmd
+}
+
+func newRootCommand() *cobra.Command {
+	root := &cobra.Command{
+		Use:           "namsor-tools",
+		Short:         "Enrich names with the NamSor API : gender, origin, diaspora, US race/ethnicity, parse and more",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			err := loadConfig(cmd)
+			if err != nil {
+				return err
+			}
+			return setupLogging(logFormat, logPolicy)
+		},
+	}
+	root.PersistentFlags().StringVarP(&apiKey, "apiKey", "a", "", "NamSor API Key, or "+envName("apiKey"))
+	root.PersistentFlags().StringVar(&apiKeyFile, "api-key-file", "", "file holding the NamSor API Key")
+	root.PersistentFlags().StringVar(&apiKeyCmd, "api-key-cmd", "", "command printing the NamSor API Key, ex. a password manager CLI")
+	root.PersistentFlags().StringVar(&configFile, FLAG_CONFIG, defaultConfigFile(), "YAML config file with named profiles of options")
+	root.PersistentFlags().StringVar(&profile, FLAG_PROFILE, "", "profile of the config file, "+DEFAULT_PROFILE+" by default")
+	root.PersistentFlags().StringVar(&logFormat, "log-format", LOG_FORMAT_TEXT, "format of the logs on stderr : "+strings.Join(LOG_FORMATS, " / "))
+	root.PersistentFlags().StringVar(&logPolicy, "log-policy", LOG_POLICY_REDACT, "names, phones and uids in logs : "+strings.Join(LOG_POLICIES, " / "))
+
+	root.AddCommand(newEnrichCommand(COMMAND_ENRICH,
+		"Append the service columns to the names of input files",
+		"Append the service columns to the names of an input file, a directory or a glob pattern, each input file to its own output file."))
+	root.AddCommand(newEnrichCommand(COMMAND_MERGE,
+		"Enrich several input files into a single output file",
+		"Enrich several input files into a single output file, with an extra sourceFile column."))
+	root.AddCommand(newEnrichCommand(COMMAND_RESUME,
+		"Continue an enrichment job where it stopped",
+		"Continue an enrichment job where it stopped : rows already in the output file, and completed input files, are skipped. Requires input data with an ID prefix (-u)."))
+
+	estimate := &cobra.Command{
+		Use:   COMMAND_ESTIMATE,
+		Short: "Estimate the credits an enrichment would use",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := currentConfig()
+			if err := options.validateInput(); err != nil {
+				return err
+			}
+			tools, err := newTools(options)
+			if err != nil {
+				return err
+			}
+			return tools.runEstimate(os.Stdout, jsonOutput)
+		},
+	}
+	addInputFlags(estimate)
+	estimate.Flags().BoolVar(&jsonOutput, "json", false, "print the estimate as JSON")
+	root.AddCommand(estimate)
+
+	account := &cobra.Command{
+		Use:   COMMAND_ACCOUNT,
+		Short: "Print the plan, credits, usage history and API status",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tools, err := newTools(currentConfig())
+			if err != nil {
+				return err
+			}
+			return tools.runAccount(os.Stdout, jsonOutput)
+		},
+	}
+	account.Flags().BoolVar(&jsonOutput, "json", false, "print the plan, credits, usage history and API status as JSON")
+	root.AddCommand(account)
+
+	taxonomy := &cobra.Command{
+		Use:       COMMAND_TAXONOMY + " [service...]",
+		Short:     "List the possible classes of each service",
+		ValidArgs: serviceTaxonomyNames(),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			tools, err := newTools(currentConfig())
+			if err != nil {
+				return err
+			}
+			return tools.runTaxonomy(os.Stdout, args, classifier, schemaFile)
+		},
+	}
+	taxonomy.Flags().StringVar(&classifier, "classifier", "", "classifier name of the service, when it isn't a known one")
+	taxonomy.Flags().StringVar(&schemaFile, "schema", "", "also write the classes of the output columns to this JSON schema file")
+	root.AddCommand(taxonomy)
+
+	login := &cobra.Command{
+		Use:   COMMAND_LOGIN,
+		Short: "Store the API key in the OS keyring",
+		Long:  "Read the API key from the terminal or stdin, check it, and store it in the OS keyring under the profile name, so that it is read from there when no other source is given.",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runLogin(profileOrDefault())
+		},
+	}
+	root.AddCommand(login)
+
+	detokenize := &cobra.Command{
+		Use:   COMMAND_DETOKENIZE,
+		Short: "Restore the values of the tokens of an output file",
+		Long:  "Restore the names, phones and uids tokenized with --vault in an output file written with --header, using the vault and its key. Each detokenization is recorded in the vault.",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if inputFile == "" || outputFile == "" || vaultFile == "" {
+				return newUsageError("detokenize requires -i <outputFile> -o <restoredFile> --vault <vaultFile>")
+			}
+			key, err := readSecretKey("vault", vaultKeyFile, VAULT_KEY_ENV)
+			if err != nil {
+				return err
+			}
+			return runDetokenize(inputFile, outputFile, overwrite, vaultFile, key)
+		},
+	}
+	detokenize.Flags().StringVarP(&inputFile, "inputFile", "i", "", "output file with tokens, - for stdin")
+	detokenize.Flags().StringVarP(&outputFile, "outputFile", "o", "", "file with the values restored, - for stdout")
+	detokenize.Flags().BoolVarP(&overwrite, "overwrite", "w", false, "overwrite existing output file")
+	detokenize.Flags().StringVar(&vaultFile, "vault", "", "vault file of the tokens")
+	detokenize.Flags().StringVar(&vaultKeyFile, "vault-key-file", "", "file holding the secret key of the vault, or "+VAULT_KEY_ENV)
+	root.AddCommand(detokenize)
+
+	verify := &cobra.Command{
+		Use:   COMMAND_VERIFY_OUTPUT + " <outputFile>...",
+		Short: "Check that output files are complete and aligned",
+		Long:  "Check that every row of the output files has the columns of the header, that uids aren't duplicated and, with -i, that every input row has an output row.",
+		Args:  usageArgs(cobra.MinimumNArgs(1)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if inputFile != "" && len(args) > 1 {
+				return newUsageError("-i checks a single output file")
+			}
+			return runVerifyOutput(os.Stdout, args, inputFile, uid)
+		},
+	}
+	verify.Flags().StringVarP(&inputFile, "inputFile", "i", "", "input file the output was produced from, to check every row was enriched")
+	verify.Flags().BoolVarP(&uid, "uid", "u", false, "input data has an ID prefix")
+	root.AddCommand(verify)
+
+	root.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageError{err}
+	})
+	return root
+}
+
+func serviceTaxonomyNames() []string {
+	var services []string
+	for _, taxonomy := range SERVICE_TAXONOMIES {
+		services = append(services, taxonomy.service)
+	}
+	return services
+}
+
+// execute runs the command line, and returns the exit code
+func execute() int {
+	// stdout may carry the output data, keep logs on stderr
+	logger.SetOutput(os.Stderr)
+
+	root := newRootCommand()
+	err := root.Execute()
+	if err != nil {
+		var recordErr recordError
+		if errors.As(err, &recordErr) {
+			logger.WithFields(recordErr.fields()).Error(err.Error())
+		} else {
+			logger.Error(err.Error())
+		}
+		var usage usageError
+		if errors.As(err, &usage) || strings.HasPrefix(err.Error(), "unknown command") {
+			cmd, _, findErr := root.Find(os.Args[1:])
+			if findErr != nil || cmd == nil {
+				cmd = root
+			}
+			cmd.SetOut(os.Stderr)
+			cmd.Usage()
+		}
+	}
+	return exitCode(err)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	logger "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of the environment variables of the options, ex. NAMSOR_API_KEY for --apiKey
+const ENV_PREFIX string = "NAMSOR_"
+
+// profile used when none is named with --profile or NAMSOR_PROFILE
+const DEFAULT_PROFILE string = "default"
+
+// config file and profile flags, which aren't options of the profiles themselves
+const FLAG_CONFIG string = "config"
+const FLAG_PROFILE string = "profile"
+
+var (
+	configFile string
+	profile    string
+)
+
+/*
+	Configuration : the options of a job, typed and validated. Each option is read, by order of precedence,
+	from the command line flag, the NAMSOR_<OPTION> environment variable, the profile of the config file,
+	or the flag default.
+*/
+type config struct {
+	ApiKey          string          `json:"apiKey,omitempty"`
+	ApiKeyFile      string          `json:"apiKeyFile,omitempty"`
+	ApiKeyCmd       string          `json:"apiKeyCmd,omitempty"`
+	ApiKeySource    string          `json:"apiKeySource,omitempty"`
+	Profile         string          `json:"profile,omitempty"`
+	InputFile       string          `json:"inputFile,omitempty"`
+	OutputFile      string          `json:"outputFile,omitempty"`
+	InputDataFormat string          `json:"inputDataFormat,omitempty"`
+	Service         string          `json:"service,omitempty"`
+	CountryIso2     string          `json:"countryIso2,omitempty"`
+	Encoding        string          `json:"encoding,omitempty"`
+	Sheet           string          `json:"sheet,omitempty"`
+	HeaderRow       int             `json:"headerRow,omitempty"`
+	Columns         string          `json:"columns,omitempty"`
+	Overwrite       bool            `json:"overwrite,omitempty"`
+	Recover         bool            `json:"recover,omitempty"`
+	Merge           bool            `json:"merge,omitempty"`
+	ParseFirst      bool            `json:"parseFirst,omitempty"`
+	KnownOrigin     bool            `json:"knownOrigin,omitempty"`
+	Anonymize       bool            `json:"anonymize,omitempty"`
+	NoLearn         bool            `json:"noLearn,omitempty"`
+	Header          bool            `json:"header,omitempty"`
+	Uid             bool            `json:"uid,omitempty"`
+	Digest          bool            `json:"digest,omitempty"`
+	DigestColumns   map[string]bool `json:"digestColumns,omitempty"`
+	DigestKeyFile   string          `json:"digestKeyFile,omitempty"`
+	DigestKey       []byte          `json:"-"`
+	Vault           string          `json:"vault,omitempty"`
+	VaultKeyFile    string          `json:"vaultKeyFile,omitempty"`
+	VaultKey        []byte          `json:"-"`
+	EncryptTo       []string        `json:"encryptTo,omitempty"`
+	Identity        string          `json:"identity,omitempty"`
+	AuditLog        string          `json:"auditLog,omitempty"`
+	MinProbability  float64         `json:"minProbability,omitempty"`
+	MinScore        float64         `json:"minScore,omitempty"`
+	ReportFile      string          `json:"reportFile,omitempty"`
+	GroupBy         string          `json:"groupBy,omitempty"`
+	KAnonymity      int             `json:"kAnonymity,omitempty"`
+}
+
+// configFileContent holds named profiles, each a map of flag names to values
+type configFileContent struct {
+	Profiles map[string]map[string]interface{} `yaml:"profiles"`
+}
+
+// currentConfig reads the options once flags, environment variables and profile are applied
+func currentConfig() config {
+	return config{
+		ApiKey:          apiKey,
+		ApiKeyFile:      apiKeyFile,
+		ApiKeyCmd:       apiKeyCmd,
+		Profile:         profileOrDefault(),
+		InputFile:       inputFile,
+		OutputFile:      outputFile,
+		InputDataFormat: inputDataFormat,
+		Service:         service,
+		CountryIso2:     countryIso2,
+		Encoding:        encoding,
+		Sheet:           sheet,
+		HeaderRow:       headerRow,
+		Columns:         columns,
+		Overwrite:       overwrite,
+		Recover:         recover,
+		Merge:           merge,
+		ParseFirst:      parseFirst,
+		KnownOrigin:     knownOrigin,
+		Anonymize:       anonymize,
+		NoLearn:         noLearn,
+		Header:          header,
+		Uid:             uid,
+		Digest:          digest || digestColumns != "" || vaultFile != "",
+		DigestKeyFile:   digestKeyFile,
+		Vault:           vaultFile,
+		VaultKeyFile:    vaultKeyFile,
+		EncryptTo:       encryptTo,
+		Identity:        identity,
+		AuditLog:        auditLog,
+		ReportFile:      reportFile,
+		GroupBy:         groupBy,
+		KAnonymity:      kAnonymity,
+	}
+}
+
+func profileOrDefault() string {
+	if profile == "" {
+		return DEFAULT_PROFILE
+	}
+	return profile
+}
+
+// redacted is a copy of the options with the secret keys redacted, for logs and manifests
+func (options config) redacted() config {
+	if options.ApiKey != "" {
+		options.ApiKey = REDACTED
+	}
+	if options.DigestKey != nil {
+		options.DigestKey = []byte(REDACTED)
+	}
+	if options.VaultKey != nil {
+		options.VaultKey = []byte(REDACTED)
+	}
+	return options
+}
+
+// String prints the options with the secret keys redacted
+func (options config) String() string {
+	type redactedConfig config
+	return fmt.Sprintf("%+v", redactedConfig(options.redacted()))
+}
+
+// validateInput checks the options every command reading input files needs
+func (options config) validateInput() error {
+	if options.InputFile == "" {
+		return newUsageError("missing input file, use -i <inputFile>")
+	}
+	if options.Service == "" || !contains(SERVICES, options.Service) {
+		return newUsageError("missing or invalid service, use -s " + strings.Join(SERVICES, " / "))
+	}
+	if !contains(INPUT_DATA_FORMAT[:], options.InputDataFormat) {
+		return newUsageError("missing or invalid input data format, use -f " + strings.Join(INPUT_DATA_FORMAT[:], " / "))
+	}
+	if options.CountryIso2 != "" && len(options.CountryIso2) != 2 {
+		return newUsageError(fmt.Sprintf("invalid countryIso2 %s, use a 2 letter country code", options.CountryIso2))
+	}
+	if options.Service == SERVICE_NAME_DIASPORA && options.InputDataFormat == INPUT_DATA_FORMAT_FULLNAME && options.CountryIso2 == "" {
+		return newUsageError("diaspora requires a geographic context, use -f " + INPUT_DATA_FORMAT_FULLNAMEGEO + " or --countryIso2 <countryIso2>")
+	}
+	if options.HeaderRow < 1 {
+		return newUsageError(fmt.Sprintf("invalid headerRow %d, rows start at 1", options.HeaderRow))
+	}
+	if options.ReportFile != "" && !isReportFile(options.ReportFile) {
+		return newUsageError(fmt.Sprintf("invalid report file %s, use a %s or %s file", options.ReportFile, REPORT_SUFFIX_JSON, REPORT_SUFFIX_HTML))
+	}
+	if options.KAnonymity < 0 {
+		return newUsageError(fmt.Sprintf("invalid --k-anonymity %d, use a positive number of rows", options.KAnonymity))
+	}
+	if options.KAnonymity > 0 && options.GroupBy == "" {
+		return newUsageError("--k-anonymity applies to the groups of --group-by")
+	}
+	if options.GroupBy != "" && !contains(THRESHOLD_SERVICES, options.Service) {
+		return newUsageError(fmt.Sprintf("service %s has no label to group, --group-by is only for %s", options.Service, strings.Join(THRESHOLD_SERVICES, " / ")))
+	}
+	if options.GroupBy != "" && options.Recover {
+		return newUsageError("an aggregated job can't be resumed, run it again")
+	}
+	if options.Recover && !options.Uid {
+		return newUsageError("resume requires input data with an ID prefix, use -u")
+	}
+	if options.Recover && len(options.EncryptTo) > 0 && options.Identity == "" {
+		return newUsageError("resuming an encrypted output requires --identity <identityFile>")
+	}
+	return nil
+}
+
+// loadDigest reads the pseudonymized columns, and the secret key of the digests or of the token vault
+func (options *config) loadDigest() error {
+	if !options.Digest {
+		return nil
+	}
+	var err error
+	options.DigestColumns, err = parseDigestColumns(digestColumns)
+	if err != nil {
+		return err
+	}
+	if options.Vault != "" {
+		// tokens instead of digests
+		options.VaultKey, err = readSecretKey("vault", options.VaultKeyFile, VAULT_KEY_ENV)
+		return err
+	}
+	options.DigestKey, err = readSecretKey("digest", options.DigestKeyFile, DIGEST_KEY_ENV)
+	return err
+}
+
+// envName is the environment variable of a flag, ex. NAMSOR_INPUT_DATA_FORMAT for --inputDataFormat
+func envName(flagName string) string {
+	var name strings.Builder
+	name.WriteString(ENV_PREFIX)
+	previous := rune(0)
+	for _, c := range flagName {
+		if c == '-' {
+			name.WriteRune('_')
+		} else {
+			if unicode.IsUpper(c) && (unicode.IsLower(previous) || unicode.IsDigit(previous)) {
+				name.WriteRune('_')
+			}
+			name.WriteRune(unicode.ToUpper(c))
+		}
+		previous = c
+	}
+	return name.String()
+}
+
+func defaultConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "namsor", "config.yaml")
+}
+
+// readProfile returns the options of the profile, none if the default config file or the profile doesn't exist
+func readProfile(fileName string, profileName string, explicit bool) (map[string]interface{}, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) && !explicit {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, newUsageError(fmt.Sprintf("can't read config file %s : %s", fileName, err.Error()))
+	}
+	if info, err := os.Stat(fileName); err == nil && info.Mode().Perm()&0077 != 0 {
+		logger.Warnf("Config file %s is readable by other users, it may hold an API key, chmod 600 %s", fileName, fileName)
+	}
+	content := configFileContent{}
+	err = yaml.Unmarshal(data, &content)
+	if err != nil {
+		return nil, newUsageError(fmt.Sprintf("invalid config file %s : %s", fileName, err.Error()))
+	}
+	options, ok := content.Profiles[profileName]
+	if !ok {
+		// the profile may only have an API key in the keyring
+		if profileName != DEFAULT_PROFILE {
+			logger.Warnf("No profile %s in config file %s", profileName, fileName)
+		}
+		return nil, nil
+	}
+	logger.Debugf("Using profile %s of config file %s", profileName, fileName)
+	return options, nil
+}
+
+// optionNames are the flags of all commands, that a profile can set
+func optionNames(root *cobra.Command) map[string]bool {
+	names := map[string]bool{}
+	var visit func(cmd *cobra.Command)
+	visit = func(cmd *cobra.Command) {
+		cmd.LocalFlags().VisitAll(func(flag *pflag.Flag) {
+			names[flag.Name] = true
+		})
+		for _, child := range cmd.Commands() {
+			visit(child)
+		}
+	}
+	visit(root)
+	delete(names, "help")
+	delete(names, FLAG_CONFIG)
+	delete(names, FLAG_PROFILE)
+	return names
+}
+
+/*
+	loadConfig sets the flags of the command which aren't on the command line, from the environment variables,
+	then from the profile of the config file. Profiles may set options of other commands, which are ignored.
+*/
+func loadConfig(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	var err error
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if err != nil || flag.Changed || flag.Name == "help" {
+			return
+		}
+		if value, ok := os.LookupEnv(envName(flag.Name)); ok {
+			if setErr := flags.Set(flag.Name, value); setErr != nil {
+				err = newUsageError(fmt.Sprintf("invalid %s : %s", envName(flag.Name), setErr.Error()))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	fileName := configFile
+	explicit := flags.Changed(FLAG_CONFIG)
+	if !explicit {
+		fileName = defaultConfigFile()
+	}
+	profileName := profileOrDefault()
+	options, err := readProfile(fileName, profileName, explicit)
+	if err != nil {
+		return err
+	}
+	known := optionNames(cmd.Root())
+	var names []string
+	for name := range options {
+		if !known[name] {
+			return newUsageError(fmt.Sprintf("unknown option %s in profile %s of config file %s", name, profileName, fileName))
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		flag := flags.Lookup(name)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		values, err := profileValues(options[name])
+		if err != nil {
+			return newUsageError(fmt.Sprintf("invalid %s in profile %s : %s", name, profileName, err.Error()))
+		}
+		if _, repeatable := flag.Value.(pflag.SliceValue); !repeatable {
+			// ex. columns: [firstName, lastName] for --columns firstName,lastName
+			values = []string{strings.Join(values, ",")}
+		}
+		for _, value := range values {
+			err = flags.Set(name, value)
+			if err != nil {
+				return newUsageError(fmt.Sprintf("invalid %s in profile %s : %s", name, profileName, err.Error()))
+			}
+		}
+	}
+	return nil
+}
+
+// profileValues are the values of an option of a profile, one for a scalar and one per element for a list
+func profileValues(option interface{}) ([]string, error) {
+	switch value := option.(type) {
+	case []interface{}:
+		values := []string{}
+		for _, element := range value {
+			switch element.(type) {
+			case []interface{}, map[string]interface{}:
+				return nil, errors.New("a list can only hold values")
+			}
+			values = append(values, fmt.Sprint(element))
+		}
+		return values, nil
+	case map[string]interface{}:
+		return nil, errors.New("expected a value or a list of values, not a map")
+	}
+	return []string{fmt.Sprint(option)}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+func TestEnvName(t *testing.T) {
+	for flagName, expected := range map[string]string{
+		"apiKey":          "NAMSOR_API_KEY",
+		"countryIso2":     "NAMSOR_COUNTRY_ISO2",
+		"digest-key-file": "NAMSOR_DIGEST_KEY_FILE",
+		"parse-first":     "NAMSOR_PARSE_FIRST",
+		"uid":             "NAMSOR_UID",
+	} {
+		if name := envName(flagName); name != expected {
+			t.Errorf("envName(%s) = %s, expected %s", flagName, name, expected)
+		}
+	}
+}
+
+// enrichWithProfile parses the arguments of the enrich command and loads the config file holding the profile
+func enrichWithProfile(t *testing.T, profile string, args ...string) (*cobra.Command, error) {
+	fileName := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(fileName, []byte("profiles:\n  default:\n"+profile), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd, _, err := newRootCommand().Find([]string{COMMAND_ENRICH})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.ParseFlags(append([]string{"--" + FLAG_CONFIG, fileName}, args...)); err != nil {
+		t.Fatal(err)
+	}
+	return cmd, loadConfig(cmd)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	os.Setenv(envName("service"), SERVICE_NAME_GENDER)
+	defer os.Unsetenv(envName("service"))
+	_, err := enrichWithProfile(t, "    countryIso2: DE\n    service: origin\n    inputDataFormat: fnln\n    headerRow: 2\n", "--countryIso2", "FR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := currentConfig()
+	if options.CountryIso2 != "FR" {
+		t.Errorf("the flag comes before the profile, countryIso2 %s", options.CountryIso2)
+	}
+	if options.Service != SERVICE_NAME_GENDER {
+		t.Errorf("the environment comes before the profile, service %s", options.Service)
+	}
+	if options.InputDataFormat != INPUT_DATA_FORMAT_FNLN || options.HeaderRow != 2 {
+		t.Errorf("the profile sets the other options, inputDataFormat %s, headerRow %d", options.InputDataFormat, options.HeaderRow)
+	}
+}
+
+func TestLoadConfigLists(t *testing.T) {
+	_, err := enrichWithProfile(t, "    encrypt-to: [age1first, age1second]\n    columns:\n      - firstName=B\n      - lastName=C\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := currentConfig()
+	if !reflect.DeepEqual(options.EncryptTo, []string{"age1first", "age1second"}) {
+		t.Errorf("a list sets a repeatable flag once per value, encryptTo %v", options.EncryptTo)
+	}
+	if options.Columns != "firstName=B,lastName=C" {
+		t.Errorf("a list sets the comma separated values of a flag, columns %s", options.Columns)
+	}
+}
+
+func TestLoadConfigMap(t *testing.T) {
+	_, err := enrichWithProfile(t, "    columns:\n      firstName: B\n")
+	if _, ok := err.(usageError); !ok {
+		t.Errorf("a map isn't an option value, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// columns that can be pseudonymized with --digest-columns
+const (
+	DIGEST_COLUMN_FIRST_NAME string = "firstName"
+	DIGEST_COLUMN_LAST_NAME  string = "lastName"
+	DIGEST_COLUMN_FULL_NAME  string = "fullName"
+	DIGEST_COLUMN_PHONE      string = "phone"
+	DIGEST_COLUMN_UID        string = "uid"
+)
+
+var DIGEST_COLUMNS = []string{DIGEST_COLUMN_FIRST_NAME, DIGEST_COLUMN_LAST_NAME, DIGEST_COLUMN_FULL_NAME, DIGEST_COLUMN_PHONE, DIGEST_COLUMN_UID}
+
+// pseudonymized with --digest alone, uids are kept to join the output back to the input
+var DIGEST_COLUMNS_DEFAULT = []string{DIGEST_COLUMN_FIRST_NAME, DIGEST_COLUMN_LAST_NAME, DIGEST_COLUMN_FULL_NAME, DIGEST_COLUMN_PHONE}
+
+// environment variable of the secret key, when not in a --digest-key-file
+const DIGEST_KEY_ENV string = "NAMSOR_DIGEST_KEY"
+
+// shorter keys are easy to guess, and then the names to recover by dictionary attack
+const DIGEST_KEY_MIN_LENGTH int = 16
+
+var (
+	digestColumns string
+	digestKeyFile string
+)
+
+/*
+	Pseudonymization : with --digest, the selected columns are replaced by the hex HMAC-SHA256 of their value
+	with a secret key, so that the same value gives the same pseudonym across files and runs, and can be joined,
+	but can't be recovered without the key. The key is read from --digest-key-file or NAMSOR_DIGEST_KEY.
+*/
+func parseDigestColumns(list string) (map[string]bool, error) {
+	names := DIGEST_COLUMNS_DEFAULT
+	if list != "" {
+		names = strings.Split(list, ",")
+	}
+	selected := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !contains(DIGEST_COLUMNS, name) {
+			return nil, newUsageError(fmt.Sprintf("invalid digest column %s, use --digest-columns %s", name, strings.Join(DIGEST_COLUMNS, ",")))
+		}
+		selected[name] = true
+	}
+	return selected, nil
+}
+
+// readSecretKey reads the secret key of --digest or --vault from its key file, or else its environment variable
+func readSecretKey(option string, fileName string, env string) ([]byte, error) {
+	var key string
+	if fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("can't read %s key file %s : %s", option, fileName, err.Error()))
+		}
+		if info, err := os.Stat(fileName); err == nil && info.Mode().Perm()&0077 != 0 {
+			logger.Warnf("%s key file %s is readable by other users, chmod 600 %s", option, fileName, fileName)
+		}
+		key = strings.TrimSpace(string(data))
+	} else {
+		key = os.Getenv(env)
+	}
+	if key == "" {
+		return nil, newUsageError(fmt.Sprintf("--%s requires a secret key, use --%s-key-file <keyFile> or %s", option, option, env))
+	}
+	if len(key) < DIGEST_KEY_MIN_LENGTH {
+		return nil, newUsageError(fmt.Sprintf("the %s key is too short, use at least %d characters", option, DIGEST_KEY_MIN_LENGTH))
+	}
+	return []byte(key), nil
+}
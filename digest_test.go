@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+)
+
+func digestTools(key string, columns map[string]bool) *NamrSorTools {
+	return NewNamSorTools(config{ApiKey: "key1234567", Digest: true, DigestColumns: columns, DigestKey: []byte(key)})
+}
+
+// digested is the pseudonym of a value, failing the test on an error
+func digested(t *testing.T, tools *NamrSorTools, column string, inClear string) string {
+	digest, err := tools.digestText(column, inClear)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestDigestText(t *testing.T) {
+	tools := digestTools("Jefe", map[string]bool{DIGEST_COLUMN_FIRST_NAME: true})
+	// HMAC-SHA256 test case 2 of RFC 4231
+	digest := digested(t, tools, DIGEST_COLUMN_FIRST_NAME, "what do ya want for nothing?")
+	if digest != "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843" {
+		t.Errorf("not the HMAC-SHA256 of the value : %s", digest)
+	}
+	if again := digested(t, tools, DIGEST_COLUMN_FIRST_NAME, "what do ya want for nothing?"); again != digest {
+		t.Errorf("the same value has another pseudonym : %s", again)
+	}
+	if other := digested(t, digestTools("Jefe2", map[string]bool{DIGEST_COLUMN_FIRST_NAME: true}), DIGEST_COLUMN_FIRST_NAME, "what do ya want for nothing?"); other == digest {
+		t.Error("another key gives the same pseudonym")
+	}
+	if kept := digested(t, tools, DIGEST_COLUMN_LAST_NAME, "Smith"); kept != "Smith" {
+		t.Errorf("a column that isn't selected is pseudonymized : %s", kept)
+	}
+	if empty := digested(t, tools, DIGEST_COLUMN_FIRST_NAME, ""); empty != "" {
+		t.Errorf("an empty value is pseudonymized : %s", empty)
+	}
+}
+
+func TestParseDigestColumns(t *testing.T) {
+	columns, err := parseDigestColumns("")
+	if err != nil || len(columns) != len(DIGEST_COLUMNS_DEFAULT) || columns[DIGEST_COLUMN_UID] {
+		t.Errorf("the default columns keep the uids : %v %v", columns, err)
+	}
+	columns, err = parseDigestColumns("uid, phone")
+	if err != nil || len(columns) != 2 || !columns[DIGEST_COLUMN_UID] || !columns[DIGEST_COLUMN_PHONE] {
+		t.Errorf("uid, phone : %v %v", columns, err)
+	}
+	if _, err := parseDigestColumns("firstName,email"); err == nil {
+		t.Error("email isn't a digest column")
+	}
+}
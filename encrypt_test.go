@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// encryptedFile writes the rows to an encrypted output file, as closeOutput ends it
+func encryptedFile(t *testing.T, encryption *outputEncryption, rows string) []byte {
+	file, err := ioutil.TempFile(t.TempDir(), "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := &encryptedOutput{file: file}
+	output.encrypter, err = encryption.encrypt(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := output.writer().Write([]byte(rows)); err != nil {
+		t.Fatal(err)
+	}
+	if err := output.Close(); err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte("Smith")) {
+		t.Error("the output is written in clear")
+	}
+	return encrypted
+}
+
+func TestEncryptAge(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption, err := parseRecipients([]string{identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryption.fileSuffix() != AGE_FILE_SUFFIX {
+		t.Errorf("suffix %s of an age output", encryption.fileSuffix())
+	}
+	encrypted := encryptedFile(t, encryption, "u1|Anna|Smith|female\n")
+	decrypted, err := age.Decrypt(bytes.NewReader(encrypted), identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ioutil.ReadAll(decrypted)
+	if err != nil || string(rows) != "u1|Anna|Smith|female\n" {
+		t.Errorf("decrypted %q %v", rows, err)
+	}
+}
+
+func TestEncryptOpenPgp(t *testing.T) {
+	entity, err := openpgp.NewEntity("Data team", "", "data@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFileName := filepath.Join(t.TempDir(), "team.asc")
+	var key bytes.Buffer
+	armored, err := armor.Encode(&key, openpgp.PublicKeyType, nil)
+	if err == nil {
+		err = entity.Serialize(armored)
+	}
+	if err == nil {
+		err = armored.Close()
+	}
+	if err == nil {
+		err = ioutil.WriteFile(keyFileName, key.Bytes(), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryption, err := parseRecipients([]string{keyFileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encryption.fileSuffix() != PGP_FILE_SUFFIX {
+		t.Errorf("suffix %s of an OpenPGP output", encryption.fileSuffix())
+	}
+	encrypted := encryptedFile(t, encryption, "u1|Anna|Smith|female\n")
+	message, err := openpgp.ReadMessage(bytes.NewReader(encrypted), openpgp.EntityList{entity}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ioutil.ReadAll(message.UnverifiedBody)
+	if err != nil || string(rows) != "u1|Anna|Smith|female\n" {
+		t.Errorf("decrypted %q %v", rows, err)
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRecipients([]string{identity.Recipient().String(), keyFileName}); err == nil {
+		t.Error("age and OpenPGP recipients are mixed")
+	}
+}
+
+func TestEncryptRecipientErrors(t *testing.T) {
+	if _, err := parseRecipients([]string{"age1notarecipient"}); err == nil {
+		t.Error("age1notarecipient is accepted")
+	}
+	if _, err := parseRecipients([]string{filepath.Join(t.TempDir(), "missing.txt")}); err == nil {
+		t.Error("a missing recipients file is accepted")
+	}
+	if encryption, err := parseRecipients(nil); encryption != nil || err != nil {
+		t.Errorf("no recipients : %v %v", encryption, err)
+	}
+}
+
+func TestEncryptedResumeRequiresIdentity(t *testing.T) {
+	options := config{InputFile: os.DevNull, InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, Uid: true, HeaderRow: 1, Recover: true, EncryptTo: []string{"age1ql3z7hjy54pw3hyww5ayyfg7zqgvc7w3j2elw8zmrj2kg5sfn9aqmcac8p"}}
+	if _, ok := options.validateInput().(usageError); !ok {
+		t.Error("an encrypted output is resumed without --identity")
+	}
+	options.Identity = "key.txt"
+	if err := options.validateInput(); err != nil {
+		t.Errorf("an encrypted output isn't resumed with --identity : %v", err)
+	}
+}
+
+// resumeTools enriches in gender to the age recipient of the identity, resuming with its file
+func resumeTools(t *testing.T, serverURL string, identity *age.X25519Identity, identityFileName string) *NamrSorTools {
+	tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, Uid: true, Encoding: "UTF-8", Recover: true, Identity: identityFileName})
+	tools.apiConfig.BasePath = serverURL
+	var err error
+	tools.encryption, err = parseRecipients([]string{identity.Recipient().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tools
+}
+
+func TestResumeEncryptedOutput(t *testing.T) {
+	server, _ := routeServer(t)
+	defer server.Close()
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFileName := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(identityFileName, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	rows := ""
+	for i := 0; i < BATCH_SIZE; i++ {
+		rows += fmt.Sprintf("u%d|Anna|Smith\n", i)
+	}
+	// the first run fails on an invalid line after a batch, the second one goes on once it is fixed
+	inputFileName := filepath.Join(dir, "in.txt")
+	if err := ioutil.WriteFile(inputFileName, []byte(rows+"invalid|Anna\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	outputFileName := filepath.Join(dir, "out.txt"+AGE_FILE_SUFFIX)
+	if _, err := resumeTools(t, server.URL, identity, identityFileName).runFile(SERVICE_NAME_GENDER, inputFileName, outputFileName, "test"); err == nil {
+		t.Fatal("the file didn't fail")
+	}
+	if err := ioutil.WriteFile(inputFileName, []byte(rows+"u_last|Anna|Smith\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the rows of the first run are decrypted and kept, the last one is added
+	if _, err := resumeTools(t, server.URL, identity, identityFileName).runFile(SERVICE_NAME_GENDER, inputFileName, outputFileName, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(outputFileName + RESUME_FILE_SUFFIX); !os.IsNotExist(err) {
+		t.Error("the resume file is left")
+	}
+	encrypted, err := os.Open(outputFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encrypted.Close()
+	decrypted, err := age.Decrypt(encrypted, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(output), "|Anna|Smith|") != BATCH_SIZE+1 || !strings.Contains(string(output), "u_last|Anna|Smith|") {
+		t.Errorf("resumed %q", output)
+	}
+}
+
+func TestResumeKilledEncryptedOutput(t *testing.T) {
+	server, _ := routeServer(t)
+	defer server.Close()
+	dir := t.TempDir()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityFileName := filepath.Join(dir, "key.txt")
+	if err := ioutil.WriteFile(identityFileName, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	inputFileName := filepath.Join(dir, "in.txt")
+	if err := ioutil.WriteFile(inputFileName, []byte("u1|Anna|Smith\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// a killed job leaves the stream without its final chunk
+	var killed bytes.Buffer
+	encrypter, err := age.Encrypt(&killed, identity.Recipient())
+	if err == nil {
+		_, err = encrypter.Write(bytes.Repeat([]byte("u0|Anna|Smith|female\n"), 4000))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	outputFileName := filepath.Join(dir, "out.txt"+AGE_FILE_SUFFIX)
+	if err := ioutil.WriteFile(outputFileName, killed.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resumeTools(t, server.URL, identity, identityFileName).runFile(SERVICE_NAME_GENDER, inputFileName, outputFileName, "test"); err == nil || !strings.Contains(err.Error(), "isn't finalized") {
+		t.Errorf("the output of a killed job is resumed : %v", err)
+	}
+	if left, err := ioutil.ReadFile(outputFileName); err != nil || !bytes.Equal(left, killed.Bytes()) {
+		t.Error("the output of a killed job is changed")
+	}
+	if _, err := os.Stat(outputFileName + RESUME_FILE_SUFFIX); !os.IsNotExist(err) {
+		t.Error("the resume file is left")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	logger "github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+)
+
+/*
+	Estimate : the rows of the input files times the cost in units of the API endpoints each row goes through,
+	after the routes of the services.
+*/
+type estimateFile struct {
+	InputFile string `json:"inputFile"`
+	Rows      int    `json:"rows"`
+}
+
+type estimateEndpoint struct {
+	Endpoint    string `json:"endpoint"`
+	UnitsPerRow int64  `json:"unitsPerRow"`
+	CostKnown   bool   `json:"costKnown"`
+	Units       int64  `json:"units"`
+}
+
+type estimateOut struct {
+	Service          string             `json:"service"`
+	InputDataFormat  string             `json:"inputDataFormat"`
+	InputFiles       []estimateFile     `json:"inputFiles"`
+	Rows             int                `json:"rows"`
+	Endpoints        []estimateEndpoint `json:"endpoints"`
+	TotalUnits       int64              `json:"totalUnits"`
+	RemainingCredits int64              `json:"remainingCredits"`
+	ExceedsRemaining bool               `json:"exceedsRemaining"`
+}
+
+// countRows counts the data rows of an input file, as process reads them
+func (tools *NamrSorTools) countRows(inputFileName string) (int, error) {
+	if isXlsx(inputFileName) {
+		workbook, err := excelize.OpenFile(inputFileName)
+		if err != nil {
+			return 0, err
+		}
+		defer workbook.Close()
+		sheet := tools.getConfig().Sheet
+		if sheet == "" {
+			sheet = workbook.GetSheetName(workbook.GetActiveSheetIndex())
+		}
+		rows, err := workbook.GetRows(sheet)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for i, row := range rows {
+			if i < tools.getConfig().HeaderRow {
+				continue
+			}
+			if strings.TrimSpace(strings.Join(row, "")) != "" {
+				count++
+			}
+		}
+		return count, nil
+	}
+	var reader io.Reader = os.Stdin
+	if inputFileName != STDIO_FILE_NAME {
+		inputFile, err := os.Open(inputFileName)
+		if err != nil {
+			return 0, err
+		}
+		defer inputFile.Close()
+		reader = inputFile
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	count := 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line != "" && !strings.HasPrefix(line, "#") {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
+
+// serviceCosts reads the cost in units of each API service, by lower case name
+func (tools *NamrSorTools) serviceCosts() (map[string]int64, error) {
+	services := namsorapi.ApiServicesOut{}
+	err := tools.callApi("GET", "/api2/json/apiServices", nil, &services)
+	if err != nil {
+		return nil, err
+	}
+	costs := map[string]int64{}
+	for _, apiService := range services.ApiServices {
+		costs[strings.ToLower(apiService.ServiceName)] = int64(apiService.CostInUnits)
+	}
+	return costs, nil
+}
+
+func (tools *NamrSorTools) estimate() (estimateOut, error) {
+	service := tools.getConfig().Service
+	inputDataFormat := tools.getConfig().InputDataFormat
+	estimate := estimateOut{Service: service, InputDataFormat: inputDataFormat}
+	endpoints, err := serviceRoute(service, inputDataFormat, tools.isParseFirst())
+	if err != nil {
+		return estimate, err
+	}
+	inputFileName := tools.getConfig().InputFile
+	inputFileNames, err := expandInputFiles(inputFileName)
+	if err != nil {
+		return estimate, err
+	}
+	if len(inputFileNames) == 0 {
+		return estimate, errors.New(fmt.Sprintf("No input file matching %s", inputFileName))
+	}
+	for _, inputFileName := range inputFileNames {
+		rows, err := tools.countRows(inputFileName)
+		if err != nil {
+			return estimate, err
+		}
+		estimate.InputFiles = append(estimate.InputFiles, estimateFile{InputFile: inputFileName, Rows: rows})
+		estimate.Rows += rows
+	}
+
+	costs, err := tools.serviceCosts()
+	if err != nil {
+		return estimate, err
+	}
+	for _, endpoint := range endpoints {
+		// the API lists the services by endpoint name, with or without the Batch suffix
+		units, known := costs[strings.ToLower(endpoint)]
+		if !known {
+			units, known = costs[strings.ToLower(strings.TrimSuffix(endpoint, "Batch"))]
+		}
+		if !known {
+			logger.Warnf("No cost for %s, counted as 1 unit per row", endpoint)
+			units = 1
+		}
+		estimateEndpoint := estimateEndpoint{
+			Endpoint:    endpoint,
+			UnitsPerRow: units,
+			CostKnown:   known,
+			Units:       units * int64(estimate.Rows),
+		}
+		estimate.Endpoints = append(estimate.Endpoints, estimateEndpoint)
+		estimate.TotalUnits += estimateEndpoint.Units
+	}
+
+	usage, _, err := tools.adminApi.ApiUsage(tools.auth)
+	if err != nil {
+		return estimate, err
+	}
+	if usage.Subscription.PlanQuota > usage.BillingPeriod.Usage {
+		estimate.RemainingCredits = usage.Subscription.PlanQuota - usage.BillingPeriod.Usage
+	}
+	estimate.ExceedsRemaining = estimate.TotalUnits > estimate.RemainingCredits
+	return estimate, nil
+}
+
+func (tools *NamrSorTools) runEstimate(writer io.Writer, asJson bool) error {
+	estimate, err := tools.estimate()
+	if err != nil {
+		return err
+	}
+	if asJson {
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(estimate)
+	}
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	for _, estimateFile := range estimate.InputFiles {
+		fmt.Fprintf(table, "%s\t%d rows\n", estimateFile.InputFile, estimateFile.Rows)
+	}
+	fmt.Fprintf(table, "%d files\t%d rows\n", len(estimate.InputFiles), estimate.Rows)
+	fmt.Fprintln(table)
+	fmt.Fprintf(table, "endpoint\tunits/row\tunits\n")
+	for _, endpoint := range estimate.Endpoints {
+		unitsPerRow := fmt.Sprintf("%d", endpoint.UnitsPerRow)
+		if !endpoint.CostKnown {
+			unitsPerRow += " (unknown)"
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\n", endpoint.Endpoint, unitsPerRow, endpoint.Units)
+	}
+	fmt.Fprintf(table, "total\t\t%d\n", estimate.TotalUnits)
+	fmt.Fprintln(table)
+	if estimate.ExceedsRemaining {
+		fmt.Fprintf(table, "Remaining credits\t%d, not enough for this job\n", estimate.RemainingCredits)
+	} else {
+		fmt.Fprintf(table, "Remaining credits\t%d\n", estimate.RemainingCredits)
+	}
+	return table.Flush()
+}
@@ -3,11 +3,18 @@ module namsor-golang-tools-v2
 go 1.15
 
 require (
+	filippo.io/age v1.2.1
+	github.com/ProtonMail/go-crypto v1.1.6
 	github.com/antihax/optional v1.0.0
 	github.com/namsor/namsor-golang-sdk2 v0.0.0-20201109135310-080434edb5ea
 	github.com/paulrosania/go-charset v0.0.0-20190326053356-55c9d7a5834c
 	github.com/sirupsen/logrus v1.7.0
+	github.com/spf13/cobra v1.8.1
 	github.com/spf13/pflag v1.0.5
-	golang.org/x/net v0.0.0-20201216054612-986b41b23924
+	github.com/xuri/excelize/v2 v2.8.1
+	github.com/zalando/go-keyring v0.2.6
+	golang.org/x/net v0.26.0
 	golang.org/x/oauth2 v0.0.0-20201208152858-08078c50e5b5 // indirect
+	golang.org/x/term v0.21.0
+	gopkg.in/yaml.v3 v3.0.1
 )
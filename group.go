@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"reflect"
+	"sort"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+)
+
+// suffix of the output file of an aggregated job, after the service
+const GROUP_FILE_SUFFIX string = ".groups"
+
+// pseudo labels of the aggregated table, in parentheses to stay apart from the labels of the services
+const GROUP_LABEL_NO_RESULT string = "(no result)"
+const GROUP_LABEL_SUPPRESSED string = "(suppressed)"
+
+var OUTPUT_DATA_GROUP_HEADER = []string{
+	"rows",
+	"count",
+	"share",
+	"expectedCount",
+	"expectedShare",
+}
+
+var (
+	groupBy    string
+	kAnonymity int
+)
+
+/*
+	Group aggregation : with --group-by <column>, the input has an extra last column, ex. a department, and the
+	output is a table of each group and label : the count of rows with the label, and the expected count, the sum
+	of the calibrated probabilities of the label (ex. the expected number of women is the sum of the probabilities
+	of being female), instead of a row per person. With --k-anonymity k, cells of 1 to k-1 rows are suppressed,
+	and groups of fewer than k rows entirely.
+*/
+type groupStats struct {
+	rows     int
+	labels   map[string]int
+	expected map[string]float64
+}
+
+func (tools *NamrSorTools) isGroupBy() bool {
+	return tools.getConfig().GroupBy != ""
+}
+
+// withGroupHeader adds the trailing group column to the input headers
+func (tools *NamrSorTools) withGroupHeader(inputHeaders []string) []string {
+	if !tools.isGroupBy() {
+		return inputHeaders
+	}
+	return append(append([]string{}, inputHeaders...), tools.getConfig().GroupBy)
+}
+
+// groupAggregates holds the groups of an output, in the order they are found
+type groupAggregates struct {
+	names  []string
+	groups map[string]*groupStats
+}
+
+func (aggregates *groupAggregates) reset() {
+	aggregates.names = nil
+	aggregates.groups = map[string]*groupStats{}
+}
+
+// record adds a result to its group, with the label it gets after the thresholds, nil when the API had no answer
+func (aggregates *groupAggregates) record(group string, result interface{}, label string) {
+	stats, ok := aggregates.groups[group]
+	if !ok {
+		stats = &groupStats{labels: map[string]int{}, expected: map[string]float64{}}
+		aggregates.groups[group] = stats
+		aggregates.names = append(aggregates.names, group)
+	}
+	stats.rows++
+	if result == nil {
+		stats.labels[GROUP_LABEL_NO_RESULT]++
+		return
+	}
+	stats.labels[label]++
+	for expectedLabel, probability := range expectedLabels(result) {
+		stats.expected[expectedLabel] += probability
+	}
+}
+
+// aggregate adds the result of a row to its group, the thresholded label when there are thresholds
+func (tools *NamrSorTools) aggregate(uid string, outputObject reflect.Value, answered bool) {
+	group := tools.rowGroups[uid]
+	delete(tools.rowGroups, uid)
+	delete(tools.geoDefaulted, uid)
+	if !answered || !outputObject.IsValid() {
+		rowsFailed++
+		tools.groups.record(group, nil, "")
+		return
+	}
+	result := outputObject.Interface()
+	tools.stats.record(result, tools.resultScript(result))
+	label, _, _, _ := confidenceOf(result)
+	if tools.isThresholded() {
+		var confidence string
+		label, confidence = tools.thresholded(result)
+		if confidence == CONFIDENCE_UNCERTAIN {
+			rowsUncertain++
+		}
+	}
+	tools.groups.record(group, result, label)
+}
+
+// expectedLabels are the calibrated probabilities of the labels of a result, the likely one and the alternative one
+func expectedLabels(output interface{}) map[string]float64 {
+	expected := map[string]float64{}
+	add := func(label string, probability float64) {
+		if label != "" && probability > 0 {
+			expected[label] += probability
+		}
+	}
+	switch result := output.(type) {
+	case namsorapi.FirstLastNameGenderedOut:
+		add(result.LikelyGender, result.ProbabilityCalibrated)
+		add(otherGender(result.LikelyGender), 1-result.ProbabilityCalibrated)
+	case namsorapi.PersonalNameGenderedOut:
+		add(result.LikelyGender, result.ProbabilityCalibrated)
+		add(otherGender(result.LikelyGender), 1-result.ProbabilityCalibrated)
+	case namsorapi.FirstLastNameOriginedOut:
+		add(result.CountryOrigin, result.ProbabilityCalibrated)
+		add(result.CountryOriginAlt, result.ProbabilityAltCalibrated)
+	case namsorapi.PersonalNameGeoOut:
+		add(result.Country, result.ProbabilityCalibrated)
+		add(result.CountryAlt, result.ProbabilityAltCalibrated)
+	case namsorapi.FirstLastNameUsRaceEthnicityOut:
+		add(result.RaceEthnicity, result.ProbabilityCalibrated)
+		add(result.RaceEthnicityAlt, result.ProbabilityAltCalibrated)
+	case castegroupedOut:
+		add(result.Castegroup, result.ProbabilityCalibrated)
+		add(result.CastegroupAlt, result.ProbabilityAltCalibrated)
+	case religionedOut:
+		add(result.Religion, result.ProbabilityCalibrated)
+		add(result.ReligionAlt, result.ProbabilityAltCalibrated)
+	}
+	return expected
+}
+
+func otherGender(gender string) string {
+	switch gender {
+	case "female":
+		return "male"
+	case "male":
+		return "female"
+	}
+	return ""
+}
+
+// suppressedLabels are the cells of 1 to k-1 rows, and the next smallest cell when only one is, so that it can't be found back from the total
+func suppressedLabels(labels map[string]int, k int) map[string]bool {
+	suppressed := map[string]bool{}
+	if k <= 1 {
+		return suppressed
+	}
+	smallest := ""
+	for label, count := range labels {
+		if count > 0 && count < k {
+			suppressed[label] = true
+		} else if count > 0 && (smallest == "" || count < labels[smallest] || count == labels[smallest] && label < smallest) {
+			smallest = label
+		}
+	}
+	if len(suppressed) == 1 && smallest != "" {
+		suppressed[smallest] = true
+	}
+	return suppressed
+}
+
+// writeGroups writes the table of the groups, sorted by name, and their labels, sorted by count
+func (tools *NamrSorTools) writeGroups(writer *bufio.Writer) error {
+	separatorOut := tools.separatorOut
+	labelColumn := labelColumnOf(tools.getConfig().Service)
+	if tools.isThresholded() {
+		labelColumn += THRESHOLDED_HEADER_SUFFIX
+	}
+	k := tools.getConfig().KAnonymity
+	_, err := writer.WriteString("#" + tools.getConfig().GroupBy + separatorOut + labelColumn + separatorOut)
+	for i, header := range OUTPUT_DATA_GROUP_HEADER {
+		if err == nil && i > 0 {
+			_, err = writer.WriteString(separatorOut)
+		}
+		if err == nil {
+			_, err = writer.WriteString(header)
+		}
+	}
+	if err == nil {
+		_, err = writer.WriteString("\n")
+	}
+	if err != nil {
+		return err
+	}
+	names := append([]string{}, tools.groups.names...)
+	sort.Strings(names)
+	for _, name := range names {
+		stats := tools.groups.groups[name]
+		if stats.rows < k {
+			_, err = writer.WriteString(name + separatorOut + GROUP_LABEL_SUPPRESSED + separatorOut + separatorOut + separatorOut + separatorOut + separatorOut + "\n")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		answered := stats.rows - stats.labels[GROUP_LABEL_NO_RESULT]
+		labels := []string{}
+		for label := range stats.labels {
+			labels = append(labels, label)
+		}
+		for label := range stats.expected {
+			if _, ok := stats.labels[label]; !ok {
+				labels = append(labels, label)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool {
+			if stats.labels[labels[i]] != stats.labels[labels[j]] {
+				return stats.labels[labels[i]] > stats.labels[labels[j]]
+			}
+			return labels[i] < labels[j]
+		})
+		suppressed := suppressedLabels(stats.labels, k)
+		for _, label := range labels {
+			if suppressed[label] {
+				continue
+			}
+			count := stats.labels[label]
+			expectedCount, expectedShare := "", ""
+			if expected, ok := stats.expected[label]; ok && answered > 0 {
+				expectedCount = fmt.Sprintf("%f", expected)
+				expectedShare = fmt.Sprintf("%f", expected/float64(answered))
+			}
+			_, err = writer.WriteString(name + separatorOut + label + separatorOut + fmt.Sprintf("%d", stats.rows) + separatorOut +
+				fmt.Sprintf("%d", count) + separatorOut + fmt.Sprintf("%f", float64(count)/float64(stats.rows)) + separatorOut +
+				expectedCount + separatorOut + expectedShare + "\n")
+			if err != nil {
+				return err
+			}
+		}
+		if len(suppressed) > 0 {
+			_, err = writer.WriteString(name + separatorOut + GROUP_LABEL_SUPPRESSED + separatorOut + fmt.Sprintf("%d", stats.rows) + separatorOut + separatorOut + separatorOut + separatorOut + "\n")
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return writer.Flush()
+}
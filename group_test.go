@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+)
+
+func TestSuppressedLabels(t *testing.T) {
+	for _, test := range []struct {
+		labels     map[string]int
+		k          int
+		suppressed []string
+	}{
+		{map[string]int{"female": 5, "male": 1}, 1, nil},
+		{map[string]int{"female": 5, "male": 4}, 3, nil},
+		// one small cell would be found back from the total, the next smallest is suppressed too
+		{map[string]int{"female": 5, "male": 2}, 3, []string{"female", "male"}},
+		{map[string]int{"female": 5, "male": 4, "unknown": 1}, 3, []string{"male", "unknown"}},
+		{map[string]int{"female": 5, "male": 2, "unknown": 1}, 3, []string{"male", "unknown"}},
+		{map[string]int{"FR": 4, "BE": 4, "CH": 1}, 3, []string{"BE", "CH"}},
+		{map[string]int{"female": 5, "male": 0}, 3, nil},
+	} {
+		suppressed := suppressedLabels(test.labels, test.k)
+		expected := map[string]bool{}
+		for _, label := range test.suppressed {
+			expected[label] = true
+		}
+		if !reflect.DeepEqual(suppressed, expected) {
+			t.Errorf("%v with k=%d : suppressed %v, expected %v", test.labels, test.k, suppressed, expected)
+		}
+	}
+}
+
+func TestExpectedLabels(t *testing.T) {
+	for _, test := range []struct {
+		result   interface{}
+		expected map[string]float64
+	}{
+		{namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.65}, map[string]float64{"female": 0.65, "male": 0.35}},
+		{namsorapi.PersonalNameGenderedOut{LikelyGender: "male", ProbabilityCalibrated: 1}, map[string]float64{"male": 1}},
+		{namsorapi.FirstLastNameOriginedOut{CountryOrigin: "FR", CountryOriginAlt: "BE", ProbabilityCalibrated: 0.65, ProbabilityAltCalibrated: 0.2}, map[string]float64{"FR": 0.65, "BE": 0.2}},
+		{namsorapi.FirstLastNameUsRaceEthnicityOut{RaceEthnicity: "W_NL", ProbabilityCalibrated: 0.8}, map[string]float64{"W_NL": 0.8}},
+		// no calibrated probability, no expected count
+		{namsorapi.FirstLastNameDiasporaedOut{Ethnicity: "French", Score: 10}, map[string]float64{}},
+		{namsorapi.FirstLastNameGenderedOut{}, map[string]float64{}},
+	} {
+		expected := expectedLabels(test.result)
+		if len(expected) != len(test.expected) {
+			t.Errorf("%+v : %v, expected %v", test.result, expected, test.expected)
+			continue
+		}
+		for label, probability := range test.expected {
+			if math.Abs(expected[label]-probability) > 1e-9 {
+				t.Errorf("%+v : %v, expected %v", test.result, expected, test.expected)
+			}
+		}
+	}
+}
+
+func TestWriteGroups(t *testing.T) {
+	tools := NewNamSorTools(config{ApiKey: "key1234567", Service: SERVICE_NAME_GENDER, GroupBy: "department", KAnonymity: 2})
+	tools.groups.reset()
+	female := namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.75}
+	male := namsorapi.FirstLastNameGenderedOut{LikelyGender: "male", ProbabilityCalibrated: 0.5}
+	for i := 0; i < 3; i++ {
+		tools.groups.record("sales", female, "female")
+	}
+	tools.groups.record("sales", male, "male")
+	tools.groups.record("sales", nil, "")
+	tools.groups.record("legal", female, "female")
+	var output bytes.Buffer
+	if err := tools.writeGroups(bufio.NewWriter(&output)); err != nil {
+		t.Fatal(err)
+	}
+	// the male and no result cells of one row are suppressed, and legal of fewer than 2 rows
+	expected := "#department|likelyGender|rows|count|share|expectedCount|expectedShare\n" +
+		"legal|(suppressed)|||||\n" +
+		"sales|female|5|3|0.600000|2.750000|0.687500\n" +
+		"sales|(suppressed)|5||||\n"
+	if output.String() != expected {
+		t.Errorf("groups\n%s\nexpected\n%s", output.String(), expected)
+	}
+}
+
+func TestAggregateScripts(t *testing.T) {
+	tools := NewNamSorTools(config{ApiKey: "key1234567", Service: SERVICE_NAME_GENDER, GroupBy: "department"})
+	tools.groups.reset()
+	tools.rowGroups["u1"], tools.rowGroups["u2"] = "sales", "sales"
+	tools.aggregate("u1", reflect.ValueOf(namsorapi.FirstLastNameGenderedOut{LastName: "Smith", LikelyGender: "female"}), true)
+	tools.aggregate("u2", reflect.ValueOf(namsorapi.FirstLastNameGenderedOut{LastName: "王", LikelyGender: "male"}), true)
+	// the script mix of the report is the same as in row mode
+	if !reflect.DeepEqual(tools.stats.scripts, map[string]int{"Latin": 1, "Han": 1}) {
+		t.Errorf("scripts %v", tools.stats.scripts)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	"strings"
+)
+
+/*
+	India specific classifiers, not in the SDK version we depend on : the requests and responses
+	follow the API models, with an Indian state or union territory (ISO 3166-2:IN) as geographic context.
+*/
+const INDIA_COUNTRY_ISO2 string = "IN"
+
+type firstLastNameGeoSubdivisionIn struct {
+	Id             string `json:"id,omitempty"`
+	FirstName      string `json:"firstName,omitempty"`
+	LastName       string `json:"lastName,omitempty"`
+	SubdivisionIso string `json:"subdivisionIso,omitempty"`
+}
+
+type personalNameGeoSubdivisionIn struct {
+	Id             string `json:"id,omitempty"`
+	Name           string `json:"name,omitempty"`
+	SubdivisionIso string `json:"subdivisionIso,omitempty"`
+}
+
+type batchFirstLastNameGeoSubdivisionIn struct {
+	PersonalNames []firstLastNameGeoSubdivisionIn `json:"personalNames,omitempty"`
+}
+
+type batchPersonalNameGeoSubdivisionIn struct {
+	PersonalNames []personalNameGeoSubdivisionIn `json:"personalNames,omitempty"`
+}
+
+// castegroupedOut is the likely caste group of a first / last name (FirstName, LastName) or of a full name (Name)
+type castegroupedOut struct {
+	Id                       string  `json:"id,omitempty"`
+	FirstName                string  `json:"firstName,omitempty"`
+	LastName                 string  `json:"lastName,omitempty"`
+	Name                     string  `json:"name,omitempty"`
+	Castegroup               string  `json:"castegroup,omitempty"`
+	CastegroupAlt            string  `json:"castegroupAlt,omitempty"`
+	Score                    float64 `json:"score,omitempty"`
+	ProbabilityCalibrated    float64 `json:"probabilityCalibrated,omitempty"`
+	ProbabilityAltCalibrated float64 `json:"probabilityAltCalibrated,omitempty"`
+}
+
+type batchCastegroupedOut struct {
+	PersonalNames []castegroupedOut `json:"personalNames,omitempty"`
+}
+
+// religionedOut is the likely religion of a first / last name (FirstName, LastName) or of a full name (Name)
+type religionedOut struct {
+	Id                       string  `json:"id,omitempty"`
+	FirstName                string  `json:"firstName,omitempty"`
+	LastName                 string  `json:"lastName,omitempty"`
+	Name                     string  `json:"name,omitempty"`
+	Religion                 string  `json:"religion,omitempty"`
+	ReligionAlt              string  `json:"religionAlt,omitempty"`
+	Score                    float64 `json:"score,omitempty"`
+	ProbabilityCalibrated    float64 `json:"probabilityCalibrated,omitempty"`
+	ProbabilityAltCalibrated float64 `json:"probabilityAltCalibrated,omitempty"`
+}
+
+type batchReligionedOut struct {
+	PersonalNames []religionedOut `json:"personalNames,omitempty"`
+}
+
+// indianSubdivisionIso reads the geo column as an Indian state, ex. IN-UP or UP
+func indianSubdivisionIso(geo string) string {
+	geo = strings.ToUpper(strings.TrimSpace(geo))
+	if geo == "" || geo == INDIA_COUNTRY_ISO2 {
+		return ""
+	}
+	if !strings.Contains(geo, "-") {
+		return INDIA_COUNTRY_ISO2 + "-" + geo
+	}
+	return geo
+}
+
+func toFirstLastNamesGeoSubdivisionIn(names []namsorapi.FirstLastNameGeoIn) batchFirstLastNameGeoSubdivisionIn {
+	data := batchFirstLastNameGeoSubdivisionIn{}
+	for _, name := range names {
+		data.PersonalNames = append(data.PersonalNames, firstLastNameGeoSubdivisionIn{
+			Id:             name.Id,
+			FirstName:      name.FirstName,
+			LastName:       name.LastName,
+			SubdivisionIso: indianSubdivisionIso(name.CountryIso2),
+		})
+	}
+	return data
+}
+
+func toPersonalNamesGeoSubdivisionIn(names []namsorapi.PersonalNameGeoIn) batchPersonalNameGeoSubdivisionIn {
+	data := batchPersonalNameGeoSubdivisionIn{}
+	for _, name := range names {
+		data.PersonalNames = append(data.PersonalNames, personalNameGeoSubdivisionIn{
+			Id:             name.Id,
+			Name:           name.Name,
+			SubdivisionIso: indianSubdivisionIso(name.CountryIso2),
+		})
+	}
+	return data
+}
+
+func (tools *NamrSorTools) processCastegroup(names []namsorapi.FirstLastNameGeoIn) (map[string]castegroupedOut, error) {
+	result := map[string]castegroupedOut{}
+	castegrouped := batchCastegroupedOut{}
+	err := tools.callApi("POST", "/api2/json/castegroupIndianBatch", toFirstLastNamesGeoSubdivisionIn(names), &castegrouped)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range castegrouped.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processCastegroupFull(names []namsorapi.PersonalNameGeoIn) (map[string]castegroupedOut, error) {
+	result := map[string]castegroupedOut{}
+	castegrouped := batchCastegroupedOut{}
+	err := tools.callApi("POST", "/api2/json/castegroupIndianFullBatch", toPersonalNamesGeoSubdivisionIn(names), &castegrouped)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range castegrouped.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processReligion(names []namsorapi.FirstLastNameGeoIn) (map[string]religionedOut, error) {
+	result := map[string]religionedOut{}
+	religioned := batchReligionedOut{}
+	err := tools.callApi("POST", "/api2/json/religionIndianBatch", toFirstLastNamesGeoSubdivisionIn(names), &religioned)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range religioned.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+func (tools *NamrSorTools) processReligionFull(names []namsorapi.PersonalNameGeoIn) (map[string]religionedOut, error) {
+	result := map[string]religionedOut{}
+	religioned := batchReligionedOut{}
+	err := tools.callApi("POST", "/api2/json/religionIndianFullBatch", toPersonalNamesGeoSubdivisionIn(names), &religioned)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range religioned.PersonalNames {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
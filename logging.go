@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+// log formats of --log-format
+const (
+	LOG_FORMAT_TEXT string = "text"
+	LOG_FORMAT_JSON string = "json"
+)
+
+var LOG_FORMATS = []string{LOG_FORMAT_TEXT, LOG_FORMAT_JSON}
+
+// record content in logs with --log-policy : replaced by ***, replaced by a keyed hash, or as is
+const (
+	LOG_POLICY_REDACT string = "redact"
+	LOG_POLICY_HASH   string = "hash"
+	LOG_POLICY_CLEAR  string = "clear"
+)
+
+var LOG_POLICIES = []string{LOG_POLICY_REDACT, LOG_POLICY_HASH, LOG_POLICY_CLEAR}
+
+// length of the hex hashes of record content in logs
+const LOG_HASH_LENGTH int = 16
+
+// reason codes of the log messages about records
+const (
+	LOG_REASON_COLUMN_COUNT     string = "column_count"
+	LOG_REASON_DONE_LINE_FORMAT string = "done_line_format"
+	LOG_REASON_ROW_NUMBER       string = "row_number"
+)
+
+var (
+	logFormat string
+	logPolicy string
+)
+
+// logHashKey keys the hashes of record content, derived from the digest key of the job if any, a random key otherwise
+var logHashKey []byte
+
+/*
+	Logging policy : record content, names, phones or uids from input and output lines, never goes in log
+	messages. It goes in a content field, redacted, hashed or in clear with --log-policy, next to structured
+	fields such as the line number and a reason code. Hashes are keyed, so that names can't be found back by
+	hashing a dictionary, but the same content gets the same hash in a run, or across runs with --digest. The
+	key of the hashes is derived from the digest key, so that they can't be matched with the output pseudonyms.
+*/
+func setupLogging(format string, policy string) error {
+	switch format {
+	case LOG_FORMAT_TEXT:
+		logger.SetFormatter(&logger.TextFormatter{})
+	case LOG_FORMAT_JSON:
+		logger.SetFormatter(&logger.JSONFormatter{})
+	default:
+		return newUsageError(fmt.Sprintf("invalid log format %s, use --log-format %s", format, strings.Join(LOG_FORMATS, " / ")))
+	}
+	if !contains(LOG_POLICIES, policy) {
+		return newUsageError(fmt.Sprintf("invalid log policy %s, use --log-policy %s", policy, strings.Join(LOG_POLICIES, " / ")))
+	}
+	logPolicy = policy
+	if logHashKey == nil {
+		logHashKey = make([]byte, 32)
+		_, err := rand.Read(logHashKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setLogHashKey hashes record content in logs with a key derived from the digest key, stable across runs
+func setLogHashKey(key []byte) {
+	if key != nil {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("log"))
+		logHashKey = mac.Sum(nil)
+	}
+}
+
+// logContent is record content as the logging policy allows it in logs
+func logContent(content string) string {
+	switch logPolicy {
+	case LOG_POLICY_CLEAR:
+		return content
+	case LOG_POLICY_HASH:
+		mac := hmac.New(sha256.New, logHashKey)
+		mac.Write([]byte(content))
+		return hex.EncodeToString(mac.Sum(nil))[:LOG_HASH_LENGTH]
+	default:
+		return REDACTED
+	}
+}
+
+// recordFields are the structured fields of a log message about a record
+func recordFields(line int, reason string, content string) logger.Fields {
+	return logger.Fields{"line": line, "reason": reason, "content": logContent(content)}
+}
+
+/*
+	recordError is an error about a record : its message has the line number and the reason, the record
+	content only goes to the log fields, under the logging policy.
+*/
+type recordError struct {
+	fileName string
+	line     int
+	reason   string
+	message  string
+	content  string
+}
+
+func (err recordError) Error() string {
+	if err.fileName != "" {
+		return fmt.Sprintf("%s : Line %d, %s", err.fileName, err.line, err.message)
+	}
+	return fmt.Sprintf("Line %d, %s", err.line, err.message)
+}
+
+func (err recordError) fields() logger.Fields {
+	return recordFields(err.line, err.reason, err.content)
+}
+
+// inFile prefixes an error of an input file with its name, keeping the record content of a recordError out of the message
+func inFile(fileName string, err error) error {
+	if recordErr, ok := err.(recordError); ok {
+		recordErr.fileName = fileName
+		return recordErr
+	}
+	return errors.New(fmt.Sprintf("%s : %s", fileName, err.Error()))
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withLogPolicy runs the test with a logging policy and hash key, restored afterwards
+func withLogPolicy(t *testing.T, policy string, key []byte, test func()) {
+	policyBefore, keyBefore := logPolicy, logHashKey
+	defer func() {
+		logPolicy, logHashKey = policyBefore, keyBefore
+	}()
+	logPolicy, logHashKey = policy, nil
+	setLogHashKey(key)
+	test()
+}
+
+func TestLogContentHash(t *testing.T) {
+	key := []byte("0123456789abcdef-digest")
+	withLogPolicy(t, LOG_POLICY_HASH, key, func() {
+		hash := logContent("u1|Anna|Smith")
+		if len(hash) != LOG_HASH_LENGTH || strings.Contains(hash, "Anna") {
+			t.Errorf("hash %s", hash)
+		}
+		if again := logContent("u1|Anna|Smith"); again != hash {
+			t.Errorf("the same content has another hash : %s", again)
+		}
+		pseudonym := digested(t, digestTools(string(key), map[string]bool{DIGEST_COLUMN_FIRST_NAME: true}), DIGEST_COLUMN_FIRST_NAME, "Anna")
+		if strings.HasPrefix(pseudonym, logContent("Anna")) {
+			t.Error("the hash in logs is the pseudonym of the output")
+		}
+	})
+}
+
+func TestLogContentPolicies(t *testing.T) {
+	withLogPolicy(t, LOG_POLICY_REDACT, nil, func() {
+		if content := logContent("u1|Anna|Smith"); content != REDACTED {
+			t.Errorf("redacted %s", content)
+		}
+	})
+	withLogPolicy(t, LOG_POLICY_CLEAR, nil, func() {
+		if content := logContent("u1|Anna|Smith"); content != "u1|Anna|Smith" {
+			t.Errorf("in clear %s", content)
+		}
+	})
+}
+
+func TestRecordError(t *testing.T) {
+	withLogPolicy(t, LOG_POLICY_REDACT, nil, func() {
+		err := inFile("in.txt", recordError{line: 3, reason: LOG_REASON_COLUMN_COUNT, message: "expected input with format : uid|firstName|lastName", content: "u3|Anna"})
+		if strings.Contains(err.Error(), "Anna") || !strings.HasPrefix(err.Error(), "in.txt : Line 3") {
+			t.Errorf("message %s", err.Error())
+		}
+		fields := err.(recordError).fields()
+		if fields["content"] != REDACTED || fields["reason"] != LOG_REASON_COLUMN_COUNT || fields["line"] != 3 {
+			t.Errorf("fields %v", fields)
+		}
+	})
+}
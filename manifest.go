@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"time"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	logger "github.com/sirupsen/logrus"
+)
+
+// suffix of the run manifest written next to an output file
+const MANIFEST_FILE_SUFFIX string = ".manifest.json"
+
+/*
+	API settings : with --anonymize or --no-learn, the anonymization or learnable flag of the API key is read,
+	set before processing and restored to its value before the run afterwards. The other flag is left as is.
+*/
+type apiKeySettings struct {
+	Anonymized bool `json:"anonymized"`
+	Learnable  bool `json:"learnable"`
+}
+
+type apiSettings struct {
+	Before   apiKeySettings `json:"before"`
+	During   apiKeySettings `json:"during"`
+	Restored bool           `json:"restored"`
+}
+
+// manifestFile is an input or output file of a run, with the SHA-256 of its content, none for stdin and stdout
+type manifestFile struct {
+	Name   string `json:"name"`
+	Sha256 string `json:"sha256,omitempty"`
+}
+
+/*
+	runManifest records how an output file was produced, for compliance. The credits used are those of the
+	whole run, read from the API usage of the billing period before and after it, and shared by all its outputs.
+*/
+type runManifest struct {
+	SoftwareVersion string         `json:"softwareVersion"`
+	Service         string         `json:"service"`
+	InputFiles      []manifestFile `json:"inputFiles"`
+	OutputFile      manifestFile   `json:"outputFile"`
+	StartedAt       time.Time      `json:"startedAt"`
+	EndedAt         time.Time      `json:"endedAt"`
+	Options         config         `json:"options"`
+	ApiSettings     *apiSettings   `json:"apiSettings,omitempty"`
+	RowsRead        int            `json:"rowsRead"`
+	RowsSent        int            `json:"rowsSent"`
+	RowsSkipped     int            `json:"rowsSkipped"`
+	RowsFailed      int            `json:"rowsFailed"`
+	RowsUncertain   int            `json:"rowsUncertain"`
+	RowsWritten     int            `json:"rowsWritten"`
+	CreditsUsed     *int64         `json:"creditsUsed,omitempty"`
+}
+
+func (tools *NamrSorTools) isApiSettingsChanged() bool {
+	return tools.anonymize || tools.noLearn
+}
+
+// readApiSettings reads the flags of the API key from its source statistics, which the SDK decodes into the wrong model
+func (tools *NamrSorTools) readApiSettings() (apiKeySettings, error) {
+	var stats namsorapi.SourceDetailedMetricsOut
+	err := tools.callApi("GET", "/api2/json/sourceStats/"+url.PathEscape(tools.getConfig().ApiKey), nil, &stats)
+	if err != nil {
+		// the error quotes the path, which holds the API key
+		return apiKeySettings{}, errors.New("can't read the anonymization and learnable settings of the API key, they are left unchanged")
+	}
+	return apiKeySettings{Anonymized: stats.Source.Anonymized, Learnable: stats.Source.Learnable}, nil
+}
+
+// setApiSettings changes the flags of the API key which differ between the from and to settings
+func (tools *NamrSorTools) setApiSettings(from apiKeySettings, to apiKeySettings) error {
+	if from.Anonymized != to.Anonymized {
+		_, err := tools.adminApi.Anonymize(tools.auth, tools.getConfig().ApiKey, to.Anonymized)
+		if err != nil {
+			return err
+		}
+	}
+	if from.Learnable != to.Learnable {
+		_, err := tools.adminApi.Learnable(tools.auth, tools.getConfig().ApiKey, to.Learnable)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Infof("API key set to anonymized=%t, learnable=%t", to.Anonymized, to.Learnable)
+	return nil
+}
+
+// runWithApiSettings processes the files with the API key settings of the job, restored whatever the outcome
+func (tools *NamrSorTools) runWithApiSettings(softwareNameAndVersion namsorapi.SoftwareVersionOut) (*apiSettings, error) {
+	if !tools.isApiSettingsChanged() {
+		return nil, tools.runFiles(softwareNameAndVersion)
+	}
+	before, err := tools.readApiSettings()
+	if err != nil {
+		return nil, err
+	}
+	settings := &apiSettings{Before: before, During: before}
+	if tools.anonymize {
+		settings.During.Anonymized = true
+	}
+	if tools.noLearn {
+		settings.During.Learnable = false
+	}
+	defer func() {
+		// also restores a flag set before the other failed
+		restoreErr := tools.setApiSettings(settings.During, settings.Before)
+		settings.Restored = restoreErr == nil
+		if restoreErr != nil {
+			logger.Errorf("Can't restore the API key settings to anonymized=%t, learnable=%t : %s", settings.Before.Anonymized, settings.Before.Learnable, restoreErr.Error())
+		}
+	}()
+	err = tools.setApiSettings(settings.Before, settings.During)
+	if err != nil {
+		return settings, err
+	}
+	return settings, tools.runFiles(softwareNameAndVersion)
+}
+
+// fileSha256 is the hex SHA-256 of a file, empty for stdin and stdout
+func fileSha256(fileName string) (string, error) {
+	if fileName == STDIO_FILE_NAME {
+		return "", nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("can't hash %s : %s", fileName, err.Error()))
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func newManifestFile(fileName string) (manifestFile, error) {
+	sha, err := fileSha256(fileName)
+	return manifestFile{Name: fileName, Sha256: sha}, err
+}
+
+// billingPeriodUsage is the number of credits used in the current billing period of the API key
+func (tools *NamrSorTools) billingPeriodUsage() (int64, error) {
+	usage, _, err := tools.adminApi.ApiUsage(tools.auth)
+	if err != nil {
+		return 0, err
+	}
+	return usage.BillingPeriod.Usage, nil
+}
+
+// buildManifests makes a manifest for each output file, with all its input files when merged, stdout included
+func (tools *NamrSorTools) buildManifests(softwareNameAndVersion string, startedAt time.Time, settings *apiSettings, creditsUsed *int64) ([]*runManifest, error) {
+	var manifests []*runManifest
+	byOutput := map[string]*runManifest{}
+	endedAt := time.Now().UTC()
+	for _, summary := range tools.summaries {
+		manifest, ok := byOutput[summary.outputFileName]
+		if !ok {
+			outputFile, err := newManifestFile(summary.outputFileName)
+			if err != nil {
+				return nil, err
+			}
+			manifest = &runManifest{
+				SoftwareVersion: softwareNameAndVersion,
+				Service:         tools.getConfig().Service,
+				OutputFile:      outputFile,
+				StartedAt:       startedAt.UTC(),
+				EndedAt:         endedAt,
+				Options:         tools.getConfig().redacted(),
+				ApiSettings:     settings,
+				CreditsUsed:     creditsUsed,
+			}
+			byOutput[summary.outputFileName] = manifest
+			manifests = append(manifests, manifest)
+		}
+		inputFile, err := newManifestFile(summary.inputFileName)
+		if err != nil {
+			return nil, err
+		}
+		manifest.InputFiles = append(manifest.InputFiles, inputFile)
+		manifest.RowsRead += summary.rowsRead
+		manifest.RowsSent += summary.rowsSent
+		manifest.RowsSkipped += summary.rowsSkipped
+		manifest.RowsFailed += summary.rowsFailed
+		manifest.RowsUncertain += summary.rowsUncertain
+		manifest.RowsWritten += summary.rowsWritten
+	}
+	return manifests, nil
+}
+
+// writeManifests writes each manifest next to its output file, except for stdout where it is only logged
+func writeManifests(manifests []*runManifest) error {
+	for _, manifest := range manifests {
+		if manifest.OutputFile.Name == STDIO_FILE_NAME {
+			data, err := json.Marshal(manifest)
+			if err != nil {
+				return err
+			}
+			logger.Infof("No manifest file for stdout, manifest : %s", string(data))
+			continue
+		}
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(manifest.OutputFile.Name+MANIFEST_FILE_SUFFIX, append(data, '\n'), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/antihax/optional"
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+)
+
+/*
+	Phone code : the phone formats carry first / last names or a full name, optionally a declared country,
+	and with --known-origin a trailing countryOrigin column with the known origin of the name.
+*/
+const PHONE_KNOWN_ORIGIN_HEADER string = "countryOrigin"
+
+// personalNamePhoneNumberIn is a full name with a phone number, parsed into first / last names before the phone code
+type personalNamePhoneNumberIn struct {
+	Id                       string
+	Name                     string
+	PhoneNumber              string
+	FirstLastNameOriginedOut namsorapi.FirstLastNameOriginedOut
+}
+
+func isPhoneFormat(inputDataFormat string) bool {
+	return inputDataFormat == INPUT_DATA_FORMAT_FNLNPHONE || inputDataFormat == INPUT_DATA_FORMAT_FULLNAMEPHONE || inputDataFormat == INPUT_DATA_FORMAT_FNLNPHONEGEO
+}
+
+// knownOriginOf reads the countryOrigin column, empty if the origin isn't known
+func knownOriginOf(countryOrigin string) namsorapi.FirstLastNameOriginedOut {
+	countryOrigin = strings.ToUpper(strings.TrimSpace(countryOrigin))
+	if countryOrigin == "" {
+		return namsorapi.FirstLastNameOriginedOut{}
+	}
+	return namsorapi.FirstLastNameOriginedOut{CountryOrigin: countryOrigin}
+}
+
+// phoneNumberE164 formats a verified international number such as +1 212-555-0100 as +12125550100
+func phoneNumberE164(internationalPhoneNumber string) string {
+	var digits strings.Builder
+	for _, r := range internationalPhoneNumber {
+		if unicode.IsDigit(r) {
+			digits.WriteRune(r)
+		}
+	}
+	if digits.Len() == 0 {
+		return ""
+	}
+	return "+" + digits.String()
+}
+
+func (tools *NamrSorTools) processPhoneCodeGeo(names []namsorapi.FirstLastNamePhoneNumberGeoIn) (map[string]namsorapi.FirstLastNamePhoneCodedOut, error) {
+	result := map[string]namsorapi.FirstLastNamePhoneCodedOut{}
+	data := namsorapi.BatchFirstLastNamePhoneNumberGeoIn{
+		PersonalNamesWithPhoneNumbers: names,
+	}
+	body := namsorapi.PhoneCodeGeoBatchOpts{
+		BatchFirstLastNamePhoneNumberGeoIn: optional.NewInterface(data),
+	}
+	phoneCoded, _, err := tools.socialApi.PhoneCodeGeoBatch(tools.auth, &body)
+	if err != nil {
+		return nil, err
+	}
+	for _, personalName := range phoneCoded.PersonalNamesWithPhoneNumbers {
+		result[personalName.Id] = personalName
+	}
+	return result, nil
+}
+
+// processPhoneCodeFull parses the full names, then codes the phone numbers with the first / last names
+func (tools *NamrSorTools) processPhoneCodeFull(names []personalNamePhoneNumberIn) (map[string]namsorapi.FirstLastNamePhoneCodedOut, error) {
+	var personalNames []namsorapi.PersonalNameIn
+	for _, name := range names {
+		personalNames = append(personalNames, namsorapi.PersonalNameIn{
+			Id:   name.Id,
+			Name: name.Name,
+		})
+	}
+	firstLastNames, err := tools.processParsedNames(personalNames)
+	if err != nil {
+		return nil, err
+	}
+	var namesWithPhoneNumbers []namsorapi.FirstLastNamePhoneNumberIn
+	for i, name := range names {
+		namesWithPhoneNumbers = append(namesWithPhoneNumbers, namsorapi.FirstLastNamePhoneNumberIn{
+			Id:                       name.Id,
+			FirstName:                firstLastNames[i].FirstName,
+			LastName:                 firstLastNames[i].LastName,
+			PhoneNumber:              name.PhoneNumber,
+			FirstLastNameOriginedOut: name.FirstLastNameOriginedOut,
+		})
+	}
+	return tools.processPhoneCode(namesWithPhoneNumbers)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	logger "github.com/sirupsen/logrus"
+)
+
+// report formats of --report, by file suffix
+const REPORT_SUFFIX_JSON string = ".json"
+const REPORT_SUFFIX_HTML string = ".html"
+
+// labels and scripts listed in the summary table, the report has them all
+const SUMMARY_TOP_COUNT int = 10
+
+// buckets of the calibrated probability histogram, from 0 to 1
+const PROBABILITY_BUCKETS int = 10
+
+var reportFile string
+
+/*
+	Run statistics : aggregates of the results, collected as the rows are written, so that the distributions
+	of a job can be checked without loading its output. Only counts are kept, no names.
+*/
+type runStats struct {
+	labels        map[string]int
+	scripts       map[string]int
+	probabilities [PROBABILITY_BUCKETS]int
+}
+
+func (stats *runStats) record(output interface{}, script string) {
+	if stats.labels == nil {
+		stats.labels = map[string]int{}
+		stats.scripts = map[string]int{}
+	}
+	label, probability, hasProbability, _ := confidenceOf(output)
+	if label != "" {
+		stats.labels[label]++
+	}
+	if hasProbability {
+		bucket := int(probability * float64(PROBABILITY_BUCKETS))
+		if bucket >= PROBABILITY_BUCKETS {
+			bucket = PROBABILITY_BUCKETS - 1
+		}
+		if bucket < 0 {
+			bucket = 0
+		}
+		stats.probabilities[bucket]++
+	}
+	if script != "" {
+		stats.scripts[script]++
+	}
+}
+
+type countShare struct {
+	Name  string  `json:"name"`
+	Count int     `json:"count"`
+	Share float64 `json:"share"`
+}
+
+type histogramBucket struct {
+	From  float64 `json:"from"`
+	To    float64 `json:"to"`
+	Count int     `json:"count"`
+}
+
+// runReport is the summary of a job, printed at its end and written with --report
+type runReport struct {
+	Service              string            `json:"service"`
+	LabelColumn          string            `json:"labelColumn,omitempty"`
+	StartedAt            time.Time         `json:"startedAt"`
+	EndedAt              time.Time         `json:"endedAt"`
+	DurationSeconds      float64           `json:"durationSeconds"`
+	RowsPerSecond        float64           `json:"rowsPerSecond"`
+	RowsRead             int               `json:"rowsRead"`
+	RowsSkipped          int               `json:"rowsSkipped"`
+	RowsSent             int               `json:"rowsSent"`
+	RowsFailed           int               `json:"rowsFailed"`
+	RowsUncertain        int               `json:"rowsUncertain"`
+	RowsWritten          int               `json:"rowsWritten"`
+	Labels               []countShare      `json:"labels,omitempty"`
+	ProbabilityHistogram []histogramBucket `json:"probabilityHistogram,omitempty"`
+	Scripts              []countShare      `json:"scripts,omitempty"`
+}
+
+// resultScript is the script of the name of a result, as appendX writes it in the script column
+func (tools *NamrSorTools) resultScript(output interface{}) string {
+	switch result := output.(type) {
+	case namsorapi.FirstLastNameGenderedOut:
+		return tools.computeScriptFirst(result.LastName)
+	case namsorapi.FirstLastNameOriginedOut:
+		return tools.computeScriptFirst(result.LastName)
+	case namsorapi.FirstLastNameDiasporaedOut:
+		return tools.computeScriptFirst(result.LastName)
+	case namsorapi.FirstLastNameUsRaceEthnicityOut:
+		return tools.computeScriptFirst(result.LastName)
+	case namsorapi.PersonalNameGenderedOut:
+		return tools.computeScriptFirst(result.Name)
+	case namsorapi.PersonalNameGeoOut:
+		return tools.computeScriptFirst(result.Name)
+	case castegroupedOut:
+		return tools.computeScriptFirst(result.LastName + result.Name)
+	case religionedOut:
+		return tools.computeScriptFirst(result.LastName + result.Name)
+	}
+	return ""
+}
+
+// isReportFile tells the --report file names of a known format
+func isReportFile(fileName string) bool {
+	suffix := strings.ToLower(filepath.Ext(fileName))
+	return suffix == REPORT_SUFFIX_JSON || suffix == REPORT_SUFFIX_HTML
+}
+
+// labelColumnOf is the output column of the label of a service, ex. likelyGender, if its results have one
+func labelColumnOf(service string) string {
+	if !contains(THRESHOLD_SERVICES, service) {
+		return ""
+	}
+	for i, val := range SERVICES {
+		if val == service {
+			return OUTPUT_DATA_HEADERS[i][0]
+		}
+	}
+	return ""
+}
+
+// totalSummary adds up the rows of all the input files of the run
+func (tools *NamrSorTools) totalSummary() fileSummary {
+	total := fileSummary{}
+	for _, summary := range tools.summaries {
+		total.rowsRead += summary.rowsRead
+		total.rowsSkipped += summary.rowsSkipped
+		total.rowsSent += summary.rowsSent
+		total.rowsFailed += summary.rowsFailed
+		total.rowsUncertain += summary.rowsUncertain
+		total.rowsWritten += summary.rowsWritten
+	}
+	return total
+}
+
+// countShares sorts the counts by decreasing count, with their share of the total
+func countShares(counts map[string]int) []countShare {
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	var shares []countShare
+	for name, count := range counts {
+		shares = append(shares, countShare{Name: name, Count: count, Share: float64(count) / float64(total)})
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		if shares[i].Count != shares[j].Count {
+			return shares[i].Count > shares[j].Count
+		}
+		return shares[i].Name < shares[j].Name
+	})
+	return shares
+}
+
+func (tools *NamrSorTools) newRunReport(startedAt time.Time) runReport {
+	total := tools.totalSummary()
+	endedAt := time.Now()
+	report := runReport{
+		Service:         tools.getConfig().Service,
+		LabelColumn:     labelColumnOf(tools.getConfig().Service),
+		StartedAt:       startedAt.UTC(),
+		EndedAt:         endedAt.UTC(),
+		DurationSeconds: endedAt.Sub(startedAt).Seconds(),
+		RowsRead:        total.rowsRead,
+		RowsSkipped:     total.rowsSkipped,
+		RowsSent:        total.rowsSent,
+		RowsFailed:      total.rowsFailed,
+		RowsUncertain:   total.rowsUncertain,
+		RowsWritten:     total.rowsWritten,
+		Labels:          countShares(tools.stats.labels),
+		Scripts:         countShares(tools.stats.scripts),
+	}
+	if report.DurationSeconds > 0 {
+		report.RowsPerSecond = float64(report.RowsWritten) / report.DurationSeconds
+	}
+	probabilities := 0
+	for _, count := range tools.stats.probabilities {
+		probabilities += count
+	}
+	if probabilities > 0 {
+		for i, count := range tools.stats.probabilities {
+			report.ProbabilityHistogram = append(report.ProbabilityHistogram, histogramBucket{
+				From:  float64(i) / float64(PROBABILITY_BUCKETS),
+				To:    float64(i+1) / float64(PROBABILITY_BUCKETS),
+				Count: count,
+			})
+		}
+	}
+	return report
+}
+
+// logRunReport prints the summary table on stderr, or logs the report as a field with --log-format json
+func logRunReport(report runReport) {
+	if logFormat == LOG_FORMAT_JSON {
+		logger.WithField("report", report).Info("Run summary")
+		return
+	}
+	writeRunSummary(os.Stderr, report)
+}
+
+func writeCountShares(table io.Writer, title string, shares []countShare) {
+	for i, share := range shares {
+		if i == SUMMARY_TOP_COUNT {
+			fmt.Fprintf(table, "\t... %d more\n", len(shares)-SUMMARY_TOP_COUNT)
+			break
+		}
+		fmt.Fprintf(table, "%s\t%s\t%d\t%.1f%%\n", title, share.Name, share.Count, 100*share.Share)
+		title = ""
+	}
+}
+
+func writeRunSummary(writer io.Writer, report runReport) error {
+	table := tabwriter.NewWriter(writer, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(table, "Service\t%s\n", report.Service)
+	fmt.Fprintf(table, "Rows\tread %d, skipped %d, sent %d, failed %d, uncertain %d, written %d\n", report.RowsRead, report.RowsSkipped, report.RowsSent, report.RowsFailed, report.RowsUncertain, report.RowsWritten)
+	fmt.Fprintf(table, "Duration\t%.1fs, %.1f rows/s\n", report.DurationSeconds, report.RowsPerSecond)
+	writeCountShares(table, report.LabelColumn, report.Labels)
+	title := "probabilityCalibrated"
+	for _, bucket := range report.ProbabilityHistogram {
+		fmt.Fprintf(table, "%s\t%.1f-%.1f\t%d\n", title, bucket.From, bucket.To, bucket.Count)
+		title = ""
+	}
+	writeCountShares(table, "script", report.Scripts)
+	return table.Flush()
+}
+
+var REPORT_HTML_TEMPLATE = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent":  func(share float64) string { return fmt.Sprintf("%.1f%%", 100*share) },
+	"barWidth": func(share float64) string { return fmt.Sprintf("%.0fpx", 300*share) },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>NamSor {{.Service}} summary</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { padding: 2px 8px; text-align: left; }
+.bar { background: #4a7ebb; height: 1em; }
+</style>
+</head>
+<body>
+<h1>NamSor {{.Service}} summary</h1>
+<table>
+<tr><th>Started</th><td>{{.StartedAt.Format "2006-01-02 15:04:05"}} UTC</td></tr>
+<tr><th>Ended</th><td>{{.EndedAt.Format "2006-01-02 15:04:05"}} UTC</td></tr>
+<tr><th>Rows</th><td>read {{.RowsRead}}, skipped {{.RowsSkipped}}, sent {{.RowsSent}}, failed {{.RowsFailed}}, uncertain {{.RowsUncertain}}, written {{.RowsWritten}}</td></tr>
+<tr><th>Throughput</th><td>{{printf "%.1f" .RowsPerSecond}} rows/s</td></tr>
+</table>
+{{if .Labels}}<h2>{{.LabelColumn}}</h2>
+<table>
+{{range .Labels}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{percent .Share}}</td><td><div class="bar" style="width: {{barWidth .Share}}"></div></td></tr>
+{{end}}</table>{{end}}
+{{if .ProbabilityHistogram}}<h2>probabilityCalibrated</h2>
+<table>
+{{range .ProbabilityHistogram}}<tr><td>{{printf "%.1f" .From}} - {{printf "%.1f" .To}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Scripts}}<h2>script</h2>
+<table>
+{{range .Scripts}}<tr><td>{{.Name}}</td><td>{{.Count}}</td><td>{{percent .Share}}</td></tr>
+{{end}}</table>{{end}}
+</body>
+</html>
+`))
+
+// writeRunReport writes the report as JSON or HTML, according to the file suffix
+func writeRunReport(fileName string, report runReport) error {
+	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if strings.ToLower(filepath.Ext(fileName)) == REPORT_SUFFIX_HTML {
+		err = REPORT_HTML_TEMPLATE.Execute(file, report)
+	} else {
+		encoder := json.NewEncoder(file)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(report)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	logger.Infof("Report written to %s", fileName)
+	return file.Close()
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+)
+
+func TestCountShares(t *testing.T) {
+	shares := countShares(map[string]int{"male": 2, "female": 6, "unknown": 2})
+	expected := []countShare{{Name: "female", Count: 6, Share: 0.6}, {Name: "male", Count: 2, Share: 0.2}, {Name: "unknown", Count: 2, Share: 0.2}}
+	if !reflect.DeepEqual(shares, expected) {
+		t.Errorf("shares %v, expected %v", shares, expected)
+	}
+	if shares := countShares(map[string]int{}); len(shares) != 0 {
+		t.Errorf("shares of no counts %v", shares)
+	}
+}
+
+func TestRunStatsRecord(t *testing.T) {
+	stats := runStats{}
+	stats.record(namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.65}, "Latin")
+	stats.record(namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 1}, "Latin")
+	stats.record(namsorapi.FirstLastNameGenderedOut{LikelyGender: "male", ProbabilityCalibrated: 0.05}, "Han")
+	// diaspora has no calibrated probability, nor parsed names a label
+	stats.record(namsorapi.FirstLastNameDiasporaedOut{Ethnicity: "French"}, "")
+	stats.record(namsorapi.PersonalNameParsedOut{}, "Latin")
+	if !reflect.DeepEqual(stats.labels, map[string]int{"female": 2, "male": 1, "French": 1}) {
+		t.Errorf("labels %v", stats.labels)
+	}
+	if !reflect.DeepEqual(stats.scripts, map[string]int{"Latin": 3, "Han": 1}) {
+		t.Errorf("scripts %v", stats.scripts)
+	}
+	// a probability of 1 is in the last bucket
+	if stats.probabilities != [PROBABILITY_BUCKETS]int{1, 0, 0, 0, 0, 0, 1, 0, 0, 1} {
+		t.Errorf("probabilities %v", stats.probabilities)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	logger "github.com/sirupsen/logrus"
+)
+
+const COMMAND_TAXONOMY string = "taxonomy"
+
+const JSON_SCHEMA_DRAFT string = "https://json-schema.org/draft/2020-12/schema"
+
+/*
+	Taxonomy : the possible classes of each classification service, read with callApi as the SDK decodes
+	them into the wrong model. Each service has a classifier, and the output columns holding its classes.
+*/
+type serviceTaxonomy struct {
+	service    string
+	classifier string
+	columns    []string
+}
+
+var SERVICE_TAXONOMIES = []serviceTaxonomy{
+	{SERVICE_NAME_GENDER, "personalname_gender", []string{"likelyGender"}},
+	{SERVICE_NAME_ORIGIN, "personalname_origin", []string{"countryOrigin", "countryOriginAlt"}},
+	{SERVICE_NAME_COUNTRY, "personalname_country", []string{"country", "countryAlt"}},
+	{SERVICE_NAME_DIASPORA, "personalname_diaspora", []string{"ethnicity", "ethnicityAlt"}},
+	{SERVICE_NAME_USRACEETHNICITY, "personalname_usraceethnicity", []string{"raceEthnicity", "raceEthnicityAlt"}},
+	{SERVICE_NAME_CASTEGROUP, "personalname_castegroup", []string{"castegroup", "castegroupAlt"}},
+	{SERVICE_NAME_RELIGION, "personalname_religion", []string{"religion", "religionAlt"}},
+}
+
+// taxonomiesFor selects the taxonomies of the given services, all of them by default, or of a single classifier
+func taxonomiesFor(services []string, classifier string) ([]serviceTaxonomy, error) {
+	if classifier != "" {
+		if len(services) != 1 {
+			return nil, errors.New("--classifier requires a single service, whose output columns hold its classes")
+		}
+		for _, taxonomy := range SERVICE_TAXONOMIES {
+			if taxonomy.service == services[0] {
+				return []serviceTaxonomy{{taxonomy.service, classifier, taxonomy.columns}}, nil
+			}
+		}
+		return []serviceTaxonomy{{services[0], classifier, nil}}, nil
+	}
+	if len(services) == 0 {
+		return SERVICE_TAXONOMIES, nil
+	}
+	var taxonomies []serviceTaxonomy
+	for _, service := range services {
+		found := false
+		for _, taxonomy := range SERVICE_TAXONOMIES {
+			if taxonomy.service == service {
+				taxonomies = append(taxonomies, taxonomy)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.New(fmt.Sprintf("No taxonomy for service %s, use --classifier <classifierName>", service))
+		}
+	}
+	return taxonomies, nil
+}
+
+func (tools *NamrSorTools) taxonomyClasses(classifier string) ([]string, error) {
+	taxonomy := namsorapi.ApiClassifierTaxonomyOut{}
+	err := tools.callApi("GET", "/api2/json/taxonomyClasses/"+url.PathEscape(classifier), nil, &taxonomy)
+	if err != nil {
+		return nil, err
+	}
+	classes := append([]string{}, taxonomy.TaxonomyClasses...)
+	sort.Strings(classes)
+	return classes, nil
+}
+
+// runTaxonomy prints service|classifierName|taxonomyClass lines, and writes the JSON schema of the output columns if asked to
+func (tools *NamrSorTools) runTaxonomy(writer io.Writer, services []string, classifier string, schemaFileName string) error {
+	taxonomies, err := taxonomiesFor(services, classifier)
+	if err != nil {
+		return err
+	}
+	separatorOut := tools.separatorOut
+	properties := map[string]interface{}{}
+	definitions := map[string]interface{}{}
+	_, err = fmt.Fprintln(writer, "#service"+separatorOut+"classifierName"+separatorOut+"taxonomyClass")
+	if err != nil {
+		return err
+	}
+	for _, taxonomy := range taxonomies {
+		classes, err := tools.taxonomyClasses(taxonomy.classifier)
+		if err != nil {
+			return err
+		}
+		for _, class := range classes {
+			_, err = fmt.Fprintln(writer, taxonomy.service+separatorOut+taxonomy.classifier+separatorOut+class)
+			if err != nil {
+				return err
+			}
+		}
+		// an empty value stands for no answer
+		definitions[taxonomy.service] = map[string]interface{}{
+			"description": "taxonomy classes of " + taxonomy.classifier,
+			"enum":        append(append([]string{}, classes...), ""),
+		}
+		for _, column := range taxonomy.columns {
+			properties[column] = map[string]interface{}{"$ref": "#/$defs/" + taxonomy.service}
+		}
+	}
+	if schemaFileName == "" {
+		return nil
+	}
+	schema := map[string]interface{}{
+		"$schema":    JSON_SCHEMA_DRAFT,
+		"title":      "NamSor output taxonomy classes",
+		"type":       "object",
+		"properties": properties,
+		"$defs":      definitions,
+	}
+	data, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return err
+	}
+	logger.Infof("Writing JSON schema to %s", schemaFileName)
+	return ioutil.WriteFile(schemaFileName, append(data, '\n'), 0644)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+	logger "github.com/sirupsen/logrus"
+)
+
+// services whose results can be thresholded with --min-probability and --min-score
+var THRESHOLD_SERVICES = []string{
+	SERVICE_NAME_GENDER,
+	SERVICE_NAME_ORIGIN,
+	SERVICE_NAME_COUNTRY,
+	SERVICE_NAME_DIASPORA,
+	SERVICE_NAME_USRACEETHNICITY,
+	SERVICE_NAME_CHINESE_GENDER,
+	SERVICE_NAME_CASTEGROUP,
+	SERVICE_NAME_RELIGION,
+}
+
+// services without a calibrated probability, thresholded on the score only
+var SCORE_ONLY_SERVICES = []string{SERVICE_NAME_DIASPORA}
+
+// labels of the thresholded results
+const THRESHOLD_LABEL_UNKNOWN string = "unknown"
+const CONFIDENCE_CONFIDENT string = "confident"
+const CONFIDENCE_UNCERTAIN string = "uncertain"
+
+// the thresholded label column is named after the label column of the service, ex. likelyGenderThresholded
+const THRESHOLDED_HEADER_SUFFIX string = "Thresholded"
+const CONFIDENCE_HEADER string = "confidence"
+
+var (
+	minProbability string
+	minScore       string
+)
+
+/*
+	Confidence thresholds : with --min-probability and/or --min-score, results whose calibrated probability or
+	score is below the threshold get the unknown label and the uncertain confidence in two extra columns, next to
+	the raw values which are kept. A threshold is a number for the service of the job, or a list of thresholds
+	by service, ex. gender=0.7,origin=0.5, which a profile can hold for all services.
+*/
+func parseThreshold(option string, spec string, service string) (float64, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	if !strings.Contains(spec, "=") {
+		if !contains(THRESHOLD_SERVICES, service) {
+			return 0, newUsageError(fmt.Sprintf("--%s : service %s has no confidence to threshold, only %s", option, service, strings.Join(THRESHOLD_SERVICES, " / ")))
+		}
+		return parseThresholdValue(option, spec)
+	}
+	threshold := 0.0
+	for _, pair := range strings.Split(spec, ",") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(keyValue[0])
+		if len(keyValue) != 2 || !contains(THRESHOLD_SERVICES, name) {
+			return 0, newUsageError(fmt.Sprintf("invalid --%s %s, expected <threshold> or <service>=<threshold>,... with a service among %s", option, pair, strings.Join(THRESHOLD_SERVICES, " / ")))
+		}
+		value, err := parseThresholdValue(option, keyValue[1])
+		if err != nil {
+			return 0, err
+		}
+		if name == service {
+			threshold = value
+		}
+	}
+	return threshold, nil
+}
+
+func parseThresholdValue(option string, text string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+	if err != nil || value < 0 {
+		return 0, newUsageError(fmt.Sprintf("invalid --%s %s, expected a positive number", option, text))
+	}
+	return value, nil
+}
+
+// loadThresholds reads the thresholds of the service of the job
+func (options *config) loadThresholds() error {
+	var err error
+	options.MinProbability, err = parseThreshold("min-probability", minProbability, options.Service)
+	if err != nil {
+		return err
+	}
+	if options.MinProbability > 1 {
+		return newUsageError(fmt.Sprintf("invalid --min-probability %g, a probability is between 0 and 1", options.MinProbability))
+	}
+	if options.MinProbability > 0 && contains(SCORE_ONLY_SERVICES, options.Service) {
+		return newUsageError(fmt.Sprintf("service %s has no calibrated probability, use --min-score", options.Service))
+	}
+	options.MinScore, err = parseThreshold("min-score", minScore, options.Service)
+	return err
+}
+
+func (tools *NamrSorTools) isThresholded() bool {
+	return tools.getConfig().MinProbability > 0 || tools.getConfig().MinScore > 0
+}
+
+// thresholdHeaders are the extra columns of the thresholded results of the service
+func thresholdHeaders(serviceHeaders []string) []string {
+	return []string{serviceHeaders[0] + THRESHOLDED_HEADER_SUFFIX, CONFIDENCE_HEADER}
+}
+
+// confidenceOf is the label of a result, with its calibrated probability if it has one and its score
+func confidenceOf(output interface{}) (string, float64, bool, float64) {
+	switch result := output.(type) {
+	case namsorapi.FirstLastNameGenderedOut:
+		return result.LikelyGender, result.ProbabilityCalibrated, true, result.Score
+	case namsorapi.PersonalNameGenderedOut:
+		return result.LikelyGender, result.ProbabilityCalibrated, true, result.Score
+	case namsorapi.FirstLastNameOriginedOut:
+		return result.CountryOrigin, result.ProbabilityCalibrated, true, result.Score
+	case namsorapi.PersonalNameGeoOut:
+		return result.Country, result.ProbabilityCalibrated, true, result.Score
+	case namsorapi.FirstLastNameDiasporaedOut:
+		return result.Ethnicity, 0, false, result.Score
+	case namsorapi.FirstLastNameUsRaceEthnicityOut:
+		return result.RaceEthnicity, result.ProbabilityCalibrated, true, result.Score
+	case castegroupedOut:
+		return result.Castegroup, result.ProbabilityCalibrated, true, result.Score
+	case religionedOut:
+		return result.Religion, result.ProbabilityCalibrated, true, result.Score
+	}
+	return "", 0, false, 0
+}
+
+// logThresholdSummary tells how many of the results of the run were below the thresholds
+func (tools *NamrSorTools) logThresholdSummary() {
+	if !tools.isThresholded() {
+		return
+	}
+	total := tools.totalSummary()
+	answered, uncertain := total.rowsSent-total.rowsFailed, total.rowsUncertain
+	percent := 0.0
+	if answered > 0 {
+		percent = 100 * float64(uncertain) / float64(answered)
+	}
+	logger.Infof("%d of %d results (%.1f%%) below the thresholds min-probability=%g min-score=%g, labelled %s", uncertain, answered, percent, tools.getConfig().MinProbability, tools.getConfig().MinScore, THRESHOLD_LABEL_UNKNOWN)
+}
+
+// thresholded is the label of a result, or unknown when it is below a threshold, and its confidence
+func (tools *NamrSorTools) thresholded(output interface{}) (string, string) {
+	label, probability, hasProbability, score := confidenceOf(output)
+	minProbability := tools.getConfig().MinProbability
+	minScore := tools.getConfig().MinScore
+	if hasProbability && minProbability > 0 && probability < minProbability || minScore > 0 && score < minScore {
+		return THRESHOLD_LABEL_UNKNOWN, CONFIDENCE_UNCERTAIN
+	}
+	return label, CONFIDENCE_CONFIDENT
+}
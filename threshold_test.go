@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+
+	namsorapi "github.com/namsor/namsor-golang-sdk2"
+)
+
+func TestParseThreshold(t *testing.T) {
+	for _, test := range []struct {
+		spec     string
+		service  string
+		expected float64
+	}{
+		{"", SERVICE_NAME_GENDER, 0},
+		{"0.7", SERVICE_NAME_GENDER, 0.7},
+		{" 0.7 ", SERVICE_NAME_ORIGIN, 0.7},
+		{"gender=0.7,origin=0.5", SERVICE_NAME_ORIGIN, 0.5},
+		{"gender=0.7, origin = 0.5", SERVICE_NAME_GENDER, 0.7},
+		// a profile may hold the thresholds of other services
+		{"gender=0.7", SERVICE_NAME_RELIGION, 0},
+		{"gender=0.7", SERVICE_NAME_PARSE, 0},
+	} {
+		threshold, err := parseThreshold("min-probability", test.spec, test.service)
+		if err != nil || threshold != test.expected {
+			t.Errorf("%s for %s : %g %v, expected %g", test.spec, test.service, threshold, err, test.expected)
+		}
+	}
+	for _, test := range []struct {
+		spec    string
+		service string
+	}{
+		{"0.7", SERVICE_NAME_PARSE},
+		{"-0.7", SERVICE_NAME_GENDER},
+		{"high", SERVICE_NAME_GENDER},
+		{"gender", SERVICE_NAME_GENDER},
+		{"parse=0.7", SERVICE_NAME_GENDER},
+		{"gender=0.7,origin=high", SERVICE_NAME_GENDER},
+	} {
+		if _, err := parseThreshold("min-probability", test.spec, test.service); err == nil {
+			t.Errorf("%s for %s is accepted", test.spec, test.service)
+		} else if _, ok := err.(usageError); !ok {
+			t.Errorf("%s for %s isn't a usage error : %v", test.spec, test.service, err)
+		}
+	}
+}
+
+// loadedThresholds are the thresholds of the flags for the service
+func loadedThresholds(service string, probability string, score string) (config, error) {
+	minProbabilityBefore, minScoreBefore := minProbability, minScore
+	defer func() {
+		minProbability, minScore = minProbabilityBefore, minScoreBefore
+	}()
+	minProbability, minScore = probability, score
+	options := config{Service: service}
+	err := options.loadThresholds()
+	return options, err
+}
+
+func TestLoadThresholds(t *testing.T) {
+	options, err := loadedThresholds(SERVICE_NAME_GENDER, "gender=0.7", "10")
+	if err != nil || options.MinProbability != 0.7 || options.MinScore != 10 {
+		t.Errorf("gender : %g %g %v", options.MinProbability, options.MinScore, err)
+	}
+	if _, err := loadedThresholds(SERVICE_NAME_GENDER, "1.5", ""); err == nil {
+		t.Error("a probability of 1.5 is accepted")
+	}
+	if _, err := loadedThresholds(SERVICE_NAME_DIASPORA, "0.7", ""); err == nil {
+		t.Error("diaspora has no calibrated probability to threshold")
+	}
+	if options, err := loadedThresholds(SERVICE_NAME_DIASPORA, "", "10"); err != nil || options.MinScore != 10 {
+		t.Errorf("diaspora : %g %v", options.MinScore, err)
+	}
+}
+
+func TestThresholded(t *testing.T) {
+	tools := NewNamSorTools(config{ApiKey: "key1234567", MinProbability: 0.7, MinScore: 5})
+	for _, test := range []struct {
+		result     interface{}
+		label      string
+		confidence string
+	}{
+		{namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.9, Score: 10}, "female", CONFIDENCE_CONFIDENT},
+		{namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.6, Score: 10}, THRESHOLD_LABEL_UNKNOWN, CONFIDENCE_UNCERTAIN},
+		{namsorapi.FirstLastNameGenderedOut{LikelyGender: "female", ProbabilityCalibrated: 0.9, Score: 2}, THRESHOLD_LABEL_UNKNOWN, CONFIDENCE_UNCERTAIN},
+		// diaspora has no calibrated probability, only its score is thresholded
+		{namsorapi.FirstLastNameDiasporaedOut{Ethnicity: "French", Score: 10}, "French", CONFIDENCE_CONFIDENT},
+	} {
+		label, confidence := tools.thresholded(test.result)
+		if label != test.label || confidence != test.confidence {
+			t.Errorf("%+v : %s %s, expected %s %s", test.result, label, confidence, test.label, test.confidence)
+		}
+	}
+}
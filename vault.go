@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	logger "github.com/sirupsen/logrus"
+)
+
+const COMMAND_DETOKENIZE string = "detokenize"
+
+// environment variable of the vault key, when not in a --vault-key-file
+const VAULT_KEY_ENV string = "NAMSOR_VAULT_KEY"
+
+// a new token is drawn this many times on a collision, before it gets one more letter
+const VAULT_TOKEN_ATTEMPTS int = 10
+
+// first line of a vault file, followed by its encrypted records
+const VAULT_FILE_HEADER string = "namsor-vault 1\n"
+
+// larger records are a corrupted vault, a record holds one name or phone
+const VAULT_RECORD_MAX_SIZE uint32 = 1 << 20
+
+// a job using the vault holds this file next to it
+const VAULT_LOCK_SUFFIX string = ".lock"
+
+// kinds of the vault records : the key check written when the vault is created, the tokens and the detokenizations
+const VAULT_RECORD_CHECK string = "check"
+const VAULT_RECORD_TOKEN string = "token"
+const VAULT_RECORD_DETOKENIZATION string = "detokenization"
+
+// output columns holding pseudonymized values, by pseudonymized column
+var DETOKENIZE_HEADERS = map[string]string{
+	"#uid":                             DIGEST_COLUMN_UID,
+	"firstName":                        DIGEST_COLUMN_FIRST_NAME,
+	"lastName":                         DIGEST_COLUMN_LAST_NAME,
+	"fullName":                         DIGEST_COLUMN_FULL_NAME,
+	"phone":                            DIGEST_COLUMN_PHONE,
+	"firstNameParsed":                  DIGEST_COLUMN_FIRST_NAME,
+	"lastNameParsed":                   DIGEST_COLUMN_LAST_NAME,
+	"givenNameParsed":                  DIGEST_COLUMN_FIRST_NAME,
+	"surnameParsed":                    DIGEST_COLUMN_LAST_NAME,
+	"givenNamePinyin":                  DIGEST_COLUMN_FIRST_NAME,
+	"surnamePinyin":                    DIGEST_COLUMN_LAST_NAME,
+	"latinName":                        DIGEST_COLUMN_FULL_NAME,
+	"latinNameAlt":                     DIGEST_COLUMN_FULL_NAME,
+	"kanjiName":                        DIGEST_COLUMN_FULL_NAME,
+	"kanjiNameAlt":                     DIGEST_COLUMN_FULL_NAME,
+	"internationalPhoneNumberVerified": DIGEST_COLUMN_PHONE,
+	"phoneNumberE164":                  DIGEST_COLUMN_PHONE,
+}
+
+var (
+	vaultFile    string
+	vaultKeyFile string
+)
+
+/*
+	Token vault : with --vault, the pseudonymized columns get random tokens of the same format as the value
+	(letters for letters, digits for digits, other characters kept) instead of digests, so that the detokenize
+	command can restore the values with the vault key. The vault file is a header line followed by records,
+	each one encrypted with AES-256-GCM : the tokens with their value, column and creation time, and the
+	detokenizations. A record is appended as soon as a token is drawn, and the records are read back in memory
+	when the vault is opened, so the same value keeps the same token. One job at a time uses a vault.
+*/
+type tokenVault struct {
+	lock     sync.Mutex
+	file     *os.File
+	fileName string
+	aead     cipher.AEAD
+	records  uint64
+	tokens   map[string]string
+	values   map[string]string
+}
+
+// vaultRecord is the clear content of an encrypted record of the vault
+type vaultRecord struct {
+	Kind     string `json:"kind"`
+	At       string `json:"at"`
+	Column   string `json:"column,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Value    string `json:"value,omitempty"`
+	FileName string `json:"fileName,omitempty"`
+	User     string `json:"user,omitempty"`
+	Tokens   int    `json:"tokens,omitempty"`
+}
+
+// vaultSubKey derives the encryption key from the vault key
+func vaultSubKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func openVault(fileName string, key []byte) (*tokenVault, error) {
+	block, err := aes.NewCipher(vaultSubKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(fileName+VAULT_LOCK_SUFFIX, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("vault %s is used by another job, or remove %s left by a job that was killed", fileName, fileName+VAULT_LOCK_SUFFIX))
+	}
+	lock.Close()
+	file, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, 0600)
+	if err == nil {
+		err = os.Chmod(fileName, 0600)
+	}
+	if err != nil {
+		os.Remove(fileName + VAULT_LOCK_SUFFIX)
+		return nil, errors.New(fmt.Sprintf("can't open vault %s : %s", fileName, err.Error()))
+	}
+	vault := &tokenVault{file: file, fileName: fileName, aead: aead, tokens: map[string]string{}, values: map[string]string{}}
+	err = vault.load()
+	if err != nil {
+		vault.close()
+		return nil, errors.New(fmt.Sprintf("vault %s : %s", fileName, err.Error()))
+	}
+	return vault, nil
+}
+
+/*
+	load reads the records of the vault, or writes the header and the key check of a new one. The last record
+	is dropped if a killed job left it incomplete, as its token was never written to an output.
+*/
+func (vault *tokenVault) load() error {
+	reader := bufio.NewReader(vault.file)
+	header := make([]byte, len(VAULT_FILE_HEADER))
+	read, err := io.ReadFull(reader, header)
+	if read == 0 && err == io.EOF {
+		_, err = vault.file.WriteString(VAULT_FILE_HEADER)
+		if err != nil {
+			return err
+		}
+		return vault.append(vaultRecord{Kind: VAULT_RECORD_CHECK, At: time.Now().UTC().Format(time.RFC3339)})
+	}
+	if err != nil || string(header) != VAULT_FILE_HEADER {
+		return errors.New("not a vault file")
+	}
+	offset := int64(len(VAULT_FILE_HEADER))
+	for {
+		var size uint32
+		err = binary.Read(reader, binary.BigEndian, &size)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err == nil && size > VAULT_RECORD_MAX_SIZE {
+			return errors.New(fmt.Sprintf("record %d is too large, the vault is corrupted", vault.records))
+		}
+		sealed := make([]byte, size)
+		if err == nil {
+			_, err = io.ReadFull(reader, sealed)
+		}
+		if err == io.ErrUnexpectedEOF {
+			logger.Warnf("Vault %s : dropping the incomplete record %d", vault.fileName, vault.records)
+			err = vault.file.Truncate(offset)
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record, err := vault.open(sealed)
+		if err != nil && vault.records == 0 {
+			return errors.New("wrong vault key")
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("record %d can't be decrypted, the vault is corrupted", vault.records))
+		}
+		if record.Kind == VAULT_RECORD_TOKEN {
+			vault.tokens[record.Column+"\x00"+record.Value] = record.Token
+			vault.values[record.Column+"\x00"+record.Token] = record.Value
+		}
+		vault.records++
+		offset += int64(4 + size)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = vault.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// close ends the use of the vault, its records are all written
+func (vault *tokenVault) close() error {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	if vault.file == nil {
+		return nil
+	}
+	err := vault.file.Sync()
+	closeErr := vault.file.Close()
+	vault.file = nil
+	os.Remove(vault.fileName + VAULT_LOCK_SUFFIX)
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// additionalData binds a record to its position in the vault, so that records can't be dropped or reordered but at the end
+func (vault *tokenVault) additionalData(index uint64) []byte {
+	data := make([]byte, len(VAULT_FILE_HEADER)+8)
+	copy(data, VAULT_FILE_HEADER)
+	binary.BigEndian.PutUint64(data[len(VAULT_FILE_HEADER):], index)
+	return data
+}
+
+// append encrypts a record at the end of the vault
+func (vault *tokenVault) append(record vaultRecord) error {
+	if vault.file == nil {
+		return errors.New(fmt.Sprintf("vault %s is closed", vault.fileName))
+	}
+	clear, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, vault.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+	sealed := vault.aead.Seal(nonce, nonce, clear, vault.additionalData(vault.records))
+	var data bytes.Buffer
+	binary.Write(&data, binary.BigEndian, uint32(len(sealed)))
+	data.Write(sealed)
+	_, err = vault.file.Write(data.Bytes())
+	if err != nil {
+		return err
+	}
+	vault.records++
+	return nil
+}
+
+func (vault *tokenVault) open(sealed []byte) (vaultRecord, error) {
+	record := vaultRecord{}
+	size := vault.aead.NonceSize()
+	if len(sealed) < size {
+		return record, errors.New("invalid sealed record")
+	}
+	clear, err := vault.aead.Open(nil, sealed[:size], sealed[size:], vault.additionalData(vault.records))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(clear, &record)
+	return record, err
+}
+
+// token of a value of the column, the one it already has in the vault or a new one
+func (vault *tokenVault) token(column string, value string) (string, error) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	if token, ok := vault.tokens[column+"\x00"+value]; ok {
+		return token, nil
+	}
+	for attempt := 0; ; attempt++ {
+		token, err := formatPreservingToken(value, attempt/VAULT_TOKEN_ATTEMPTS)
+		if err != nil {
+			return "", err
+		}
+		if _, taken := vault.values[column+"\x00"+token]; taken {
+			// another value has this token
+			continue
+		}
+		// the token is in the vault before it can be in an output
+		err = vault.append(vaultRecord{Kind: VAULT_RECORD_TOKEN, At: time.Now().UTC().Format(time.RFC3339), Column: column, Token: token, Value: value})
+		if err != nil {
+			return "", err
+		}
+		vault.tokens[column+"\x00"+value] = token
+		vault.values[column+"\x00"+token] = value
+		return token, nil
+	}
+}
+
+// value of a token of the column, if it is in the vault
+func (vault *tokenVault) value(column string, token string) (string, bool) {
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	value, found := vault.values[column+"\x00"+token]
+	return value, found
+}
+
+func randomRune(from rune, count int64) (rune, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(count))
+	if err != nil {
+		return 0, err
+	}
+	return from + rune(n.Int64()), nil
+}
+
+// formatPreservingToken draws a random token with the format of the value, and extra letters
+func formatPreservingToken(value string, extra int) (string, error) {
+	var token strings.Builder
+	for _, c := range value {
+		var err error
+		switch {
+		case unicode.IsUpper(c):
+			c, err = randomRune('A', 26)
+		case unicode.IsLetter(c):
+			c, err = randomRune('a', 26)
+		case unicode.IsDigit(c):
+			c, err = randomRune('0', 10)
+		}
+		if err != nil {
+			return "", err
+		}
+		token.WriteRune(c)
+	}
+	for i := 0; i < extra; i++ {
+		c, err := randomRune('a', 26)
+		if err != nil {
+			return "", err
+		}
+		token.WriteRune(c)
+	}
+	return token.String(), nil
+}
+
+/*
+	detokenize restores the values of the tokens of an output file, in the columns found from its header line.
+	Each detokenization is recorded in the vault, with the file and the OS user.
+*/
+func (vault *tokenVault) detokenize(inputFileName string, writer io.Writer) (int, error) {
+	var reader io.Reader = os.Stdin
+	if inputFileName != STDIO_FILE_NAME {
+		file, err := os.Open(inputFileName)
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		reader = file
+	}
+	lines := bufio.NewScanner(reader)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	var columns []string
+	restored := 0
+	for lines.Scan() {
+		line := lines.Text()
+		values := strings.Split(line, "|")
+		if columns == nil {
+			if !strings.HasPrefix(line, "#uid") {
+				return restored, newUsageError(fmt.Sprintf("%s has no #uid header line, detokenize needs the output of --header", inputFileName))
+			}
+			columns = make([]string, len(values))
+			for i, header := range values {
+				columns[i] = DETOKENIZE_HEADERS[header]
+			}
+		} else if !strings.HasPrefix(line, "#") {
+			for i, value := range values {
+				if i >= len(columns) || columns[i] == "" || value == "" {
+					continue
+				}
+				clear, found := vault.value(columns[i], value)
+				if found {
+					values[i] = clear
+					restored++
+				}
+			}
+			line = strings.Join(values, "|")
+		}
+		_, err := fmt.Fprintln(writer, line)
+		if err != nil {
+			return restored, err
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return restored, err
+	}
+	vault.lock.Lock()
+	defer vault.lock.Unlock()
+	return restored, vault.append(vaultRecord{Kind: VAULT_RECORD_DETOKENIZATION, At: time.Now().UTC().Format(time.RFC3339), FileName: inputFileName, User: currentUserName(), Tokens: restored})
+}
+
+// runDetokenize writes the output file with its tokens restored
+func runDetokenize(inputFileName string, outputFileName string, overwrite bool, vaultFileName string, key []byte) (err error) {
+	if _, err := os.Stat(vaultFileName); err != nil {
+		return errors.New(fmt.Sprintf("can't read vault %s : %s", vaultFileName, err.Error()))
+	}
+	vault, err := openVault(vaultFileName, key)
+	if err != nil {
+		return err
+	}
+	defer vault.close()
+	var writer io.Writer = os.Stdout
+	if outputFileName != STDIO_FILE_NAME {
+		if _, err := os.Stat(outputFileName); err == nil && !overwrite {
+			return errors.New(fmt.Sprintf("OutputFile %s already exsists, use -w to overwrite", outputFileName))
+		}
+		var file *os.File
+		file, err = os.OpenFile(outputFileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		buffered := bufio.NewWriter(file)
+		defer func() {
+			// a restored file that can't be written entirely is an error, not a truncated success
+			flushErr := buffered.Flush()
+			closeErr := file.Close()
+			if err == nil && flushErr != nil {
+				err = flushErr
+			}
+			if err == nil && closeErr != nil {
+				err = closeErr
+			}
+		}()
+		writer = buffered
+	}
+	restored, err := vault.detokenize(inputFileName, writer)
+	if err != nil {
+		return err
+	}
+	logger.Infof("Detokenized %d values of %s with vault %s", restored, inputFileName, vaultFileName)
+	return nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+const testVaultKey string = "0123456789abcdef-vault"
+
+func testVault(t *testing.T, fileName string, key string) *tokenVault {
+	vault, err := openVault(fileName, []byte(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vault
+}
+
+func TestFormatPreservingToken(t *testing.T) {
+	token, err := formatPreservingToken("Jean-Luc 06 12", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runes, expected := []rune(token), []rune("Jean-Luc 06 12")
+	if len(runes) != len(expected)+2 {
+		t.Fatalf("%s doesn't have the length of the value and 2 more letters", token)
+	}
+	for i, c := range expected {
+		switch {
+		case unicode.IsUpper(c) && !unicode.IsUpper(runes[i]),
+			unicode.IsLower(c) && !unicode.IsLower(runes[i]),
+			unicode.IsDigit(c) && !unicode.IsDigit(runes[i]),
+			!unicode.IsLetter(c) && !unicode.IsDigit(c) && runes[i] != c:
+			t.Errorf("%s doesn't have the format of Jean-Luc 06 12", token)
+		}
+	}
+}
+
+func TestVaultRoundTrip(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "namsor.vault")
+	vault := testVault(t, fileName, testVaultKey)
+	token, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "John")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "John"); err != nil || again != token {
+		t.Errorf("the same value has another token : %s %v", again, err)
+	}
+	if value, found := vault.value(DIGEST_COLUMN_LAST_NAME, token); found {
+		t.Errorf("the token of a first name is restored as a last name : %s", value)
+	}
+	if err := vault.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openVault(fileName, []byte("another key of the vault")); err == nil || !strings.Contains(err.Error(), "wrong vault key") {
+		t.Errorf("the vault opens with another key : %v", err)
+	}
+
+	vault = testVault(t, fileName, testVaultKey)
+	defer vault.close()
+	if value, found := vault.value(DIGEST_COLUMN_FIRST_NAME, token); !found || value != "John" {
+		t.Errorf("%s isn't restored as John after reopening the vault : %s %v", token, value, found)
+	}
+	if _, err := openVault(fileName, []byte(testVaultKey)); err == nil {
+		t.Error("the vault is opened by two jobs")
+	}
+}
+
+func TestVaultFileEncrypted(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "namsor.vault")
+	vault := testVault(t, fileName, testVaultKey)
+	token, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "Johnathan")
+	if err == nil {
+		_, err = vault.detokenize(os.DevNull, ioutil.Discard)
+	}
+	if err == nil {
+		err = vault.close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clear := range []string{"Johnathan", token, DIGEST_COLUMN_FIRST_NAME, VAULT_RECORD_TOKEN, VAULT_RECORD_DETOKENIZATION, os.DevNull} {
+		if bytes.Contains(data, []byte(clear)) {
+			t.Errorf("%s is in clear in the vault file", clear)
+		}
+	}
+}
+
+func TestVaultIncompleteRecord(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "namsor.vault")
+	vault := testVault(t, fileName, testVaultKey)
+	token, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "John")
+	if err == nil {
+		err = vault.close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a job killed while appending a record
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = file.Write([]byte{0, 0, 0, 60, 1, 2, 3})
+		file.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault = testVault(t, fileName, testVaultKey)
+	other, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "Anna")
+	if err == nil {
+		err = vault.close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	vault = testVault(t, fileName, testVaultKey)
+	defer vault.close()
+	if value, found := vault.value(DIGEST_COLUMN_FIRST_NAME, token); !found || value != "John" {
+		t.Errorf("%s isn't restored as John : %s", token, value)
+	}
+	if value, found := vault.value(DIGEST_COLUMN_FIRST_NAME, other); !found || value != "Anna" {
+		t.Errorf("%s appended after the incomplete record isn't restored as Anna : %s", other, value)
+	}
+}
+
+func TestDetokenize(t *testing.T) {
+	dir := t.TempDir()
+	vaultFileName := filepath.Join(dir, "namsor.vault")
+	vault := testVault(t, vaultFileName, testVaultKey)
+	firstName, err := vault.token(DIGEST_COLUMN_FIRST_NAME, "Anna")
+	if err == nil {
+		var uid string
+		uid, err = vault.token(DIGEST_COLUMN_UID, "u1")
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(dir, "out.namsor"), []byte("#uid|firstName|likelyGender\n"+uid+"|"+firstName+"|female\n"), 0600)
+		}
+	}
+	vault.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoredFileName := filepath.Join(dir, "restored.txt")
+	err = runDetokenize(filepath.Join(dir, "out.namsor"), restoredFileName, false, vaultFileName, []byte(testVaultKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := ioutil.ReadFile(restoredFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(restored) != "#uid|firstName|likelyGender\nu1|Anna|female\n" {
+		t.Errorf("restored %q", restored)
+	}
+	if err := runDetokenize(filepath.Join(dir, "out.namsor"), restoredFileName, false, vaultFileName, []byte(testVaultKey)); err == nil {
+		t.Error("the restored file is overwritten without -w")
+	}
+}
+
+func TestVaultTokenCollisions(t *testing.T) {
+	vault := testVault(t, filepath.Join(t.TempDir(), "namsor.vault"), testVaultKey)
+	defer vault.close()
+	// ten digits for ten tokens of one digit, most draws collide
+	tokens := map[string]string{}
+	for digit := '0'; digit <= '9'; digit++ {
+		token, err := vault.token(DIGEST_COLUMN_UID, string(digit))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := tokens[token]; ok {
+			t.Errorf("%c and %s have the same token %s", digit, other, token)
+		}
+		tokens[token] = string(digit)
+	}
+}
+
+func TestVaultErrorFailsProcess(t *testing.T) {
+	server, _ := routeServer(t)
+	defer server.Close()
+	tools := NewNamSorTools(config{ApiKey: "key1234567", InputDataFormat: INPUT_DATA_FORMAT_FNLN, Service: SERVICE_NAME_GENDER, Uid: true, Digest: true, DigestColumns: map[string]bool{DIGEST_COLUMN_FIRST_NAME: true}})
+	tools.apiConfig.BasePath = server.URL
+	tools.vault = testVault(t, filepath.Join(t.TempDir(), "namsor.vault"), testVaultKey)
+	// the closed database fails the tokens of the batch
+	tools.vault.close()
+	var output bytes.Buffer
+	writer := bufio.NewWriter(&output)
+	if err := tools.process(SERVICE_NAME_GENDER, bufio.NewReader(strings.NewReader("u1|Anna|Smith\n")), writer, "test", &fileSummary{}); err == nil {
+		t.Errorf("a vault error doesn't fail the file : %q", output.String())
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// at most this many problems are printed per output file
+const VERIFY_MAX_PROBLEMS int = 20
+
+/*
+	Verify output : every row has the columns of the header (or of the first row), uids aren't duplicated,
+	rowIds are numbers and, given the input file, every input row has an output row.
+*/
+type outputVerification struct {
+	outputFileName string
+	rows           int
+	problems       []string
+	problemCount   int
+}
+
+func (verification *outputVerification) problem(format string, args ...interface{}) {
+	verification.problemCount++
+	if len(verification.problems) < VERIFY_MAX_PROBLEMS {
+		verification.problems = append(verification.problems, fmt.Sprintf(format, args...))
+	}
+}
+
+// readLines calls readLine with each line of the file, without the line ending
+func readLines(fileName string, readLine func(lineNumber int, line string)) error {
+	var reader io.Reader = os.Stdin
+	if fileName != STDIO_FILE_NAME {
+		file, err := os.Open(fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		reader = file
+	}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		readLine(lineNumber, strings.TrimRight(scanner.Text(), "\r"))
+	}
+	return scanner.Err()
+}
+
+func verifyOutput(outputFileName string, inputFileName string, withUID bool) (outputVerification, error) {
+	verification := outputVerification{outputFileName: outputFileName}
+	if isXlsx(outputFileName) {
+		return verification, errors.New(fmt.Sprintf("%s : verify-output reads pipe-delimited output files", outputFileName))
+	}
+	expectedColumns := -1
+	rowIdColumn := -1
+	merged := false
+	seen := map[string]bool{}
+	err := readLines(outputFileName, func(lineNumber int, line string) {
+		if line == "" {
+			return
+		}
+		values := strings.Split(line, "|")
+		if strings.HasPrefix(line, "#uid") {
+			expectedColumns = len(values)
+			for i, value := range values {
+				if value == "rowId" {
+					rowIdColumn = i
+				}
+			}
+			merged = values[len(values)-1] == "sourceFile"
+			return
+		}
+		if strings.HasPrefix(line, "#") {
+			return
+		}
+		verification.rows++
+		if expectedColumns < 0 {
+			expectedColumns = len(values)
+		}
+		if len(values) != expectedColumns {
+			verification.problem("line %d : %d columns, expected %d", lineNumber, len(values), expectedColumns)
+			return
+		}
+		key := values[0]
+		if merged {
+			key += "|" + values[len(values)-1]
+		}
+		if seen[key] {
+			verification.problem("line %d : duplicate uid %s", lineNumber, key)
+		}
+		seen[key] = true
+		if rowIdColumn >= 0 {
+			if _, err := strconv.Atoi(values[rowIdColumn]); err != nil {
+				verification.problem("line %d : invalid rowId %s", lineNumber, values[rowIdColumn])
+			}
+		}
+	})
+	if err != nil || inputFileName == "" {
+		return verification, err
+	}
+
+	inputRows := 0
+	err = readLines(inputFileName, func(lineNumber int, line string) {
+		if line == "" || strings.HasPrefix(line, "#") {
+			return
+		}
+		inputRows++
+		if withUID && !merged && !seen[strings.SplitN(line, "|", 2)[0]] {
+			verification.problem("input line %d : no output row for uid %s", lineNumber, strings.SplitN(line, "|", 2)[0])
+		}
+	})
+	if err != nil {
+		return verification, err
+	}
+	if inputRows != verification.rows {
+		verification.problem("%d input rows, %d output rows", inputRows, verification.rows)
+	}
+	return verification, nil
+}
+
+// runVerifyOutput prints a report for each output file, and fails if any has a problem
+func runVerifyOutput(writer io.Writer, outputFileNames []string, inputFileName string, withUID bool) error {
+	failed := 0
+	for _, outputFileName := range outputFileNames {
+		verification, err := verifyOutput(outputFileName, inputFileName, withUID)
+		if err != nil {
+			return err
+		}
+		if verification.problemCount == 0 {
+			fmt.Fprintf(writer, "OK %s : %d rows\n", outputFileName, verification.rows)
+			continue
+		}
+		failed++
+		fmt.Fprintf(writer, "FAILED %s : %d rows, %d problems\n", outputFileName, verification.rows, verification.problemCount)
+		for _, problem := range verification.problems {
+			fmt.Fprintf(writer, "  %s\n", problem)
+		}
+		if verification.problemCount > len(verification.problems) {
+			fmt.Fprintf(writer, "  ...\n")
+		}
+	}
+	if failed > 0 {
+		return verifyError{errors.New(fmt.Sprintf("%d of %d output files failed verification", failed, len(outputFileNames)))}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	logger "github.com/sirupsen/logrus"
+	"github.com/xuri/excelize/v2"
+)
+
+const XLSX_FILE_SUFFIX string = ".xlsx"
+
+// suffix of the enriched copy of the input sheet
+const XLSX_SHEET_SUFFIX string = " namsor"
+
+// max length of an Excel sheet name
+const XLSX_SHEET_NAME_MAX int = 31
+
+func isXlsx(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), XLSX_FILE_SUFFIX)
+}
+
+/*
+	Excel processing : the chosen sheet is converted to the pipe-delimited input format,
+	processed as usual, and the service columns are appended to a copy of that sheet.
+*/
+func (tools *NamrSorTools) runXlsx(service string, inputFileName string, outputFileName string, softwareNameAndVersion string) (fileSummary, error) {
+	summary := fileSummary{inputFileName: inputFileName, outputFileName: outputFileName}
+	if inputFileName == STDIO_FILE_NAME || outputFileName == STDIO_FILE_NAME {
+		return summary, errors.New("Excel files can't be read from stdin or written to stdout")
+	}
+	if tools.isRecover() || tools.isMerge() {
+		return summary, errors.New("Excel files can't be recovered or merged")
+	}
+	if tools.isGroupBy() {
+		return summary, errors.New("Excel files can't be grouped, the results are appended to the rows of the sheet")
+	}
+	if tools.digestColumns[DIGEST_COLUMN_UID] {
+		return summary, errors.New("Excel rows are matched by row number, the uid can't be pseudonymized")
+	}
+	if !isXlsx(trimEncryptedSuffix(outputFileName)) {
+		return summary, errors.New(fmt.Sprintf("Excel output file %s should have the %s extension", outputFileName, XLSX_FILE_SUFFIX))
+	}
+	if _, err := os.Stat(outputFileName); err == nil && !tools.getConfig().Overwrite {
+		return summary, errors.New(fmt.Sprintf("OutputFile %s already exsists, use -w to overwrite", outputFileName))
+	}
+	inputDataFormat := tools.getConfig().InputDataFormat
+	inputHeaders, err := tools.inputHeadersFor(inputDataFormat)
+	if err != nil {
+		return summary, err
+	}
+	outputHeaders, err := tools.outputHeadersFor(service)
+	if err != nil {
+		return summary, err
+	}
+
+	workbook, err := excelize.OpenFile(inputFileName)
+	if err != nil {
+		return summary, err
+	}
+	defer workbook.Close()
+	sheet := tools.getConfig().Sheet
+	if sheet == "" {
+		sheet = workbook.GetSheetName(workbook.GetActiveSheetIndex())
+	}
+	sheetIndex, err := workbook.GetSheetIndex(sheet)
+	if err != nil || sheetIndex < 0 {
+		return summary, errors.New(fmt.Sprintf("No sheet %s in %s", sheet, inputFileName))
+	}
+	rows, err := workbook.GetRows(sheet)
+	if err != nil {
+		return summary, err
+	}
+	headerRow := tools.getConfig().HeaderRow
+	if headerRow < 1 || headerRow > len(rows) {
+		return summary, errors.New(fmt.Sprintf("Header row %d is out of sheet %s", headerRow, sheet))
+	}
+	columns, err := xlsxColumns(rows[headerRow-1], inputHeaders, tools.getConfig().Columns)
+	if err != nil {
+		return summary, err
+	}
+
+	// the spreadsheet row number is the uid, to append the results on the right row
+	var input strings.Builder
+	lastColumn := 0
+	for i, row := range rows {
+		if len(row) > lastColumn {
+			lastColumn = len(row)
+		}
+		if i < headerRow {
+			continue
+		}
+		line := strconv.Itoa(i + 1)
+		empty := true
+		for _, column := range columns {
+			value := ""
+			if column < len(row) {
+				value = strings.NewReplacer(tools.separatorIn, " ", "\n", " ", "\r", " ").Replace(row[column])
+			}
+			if strings.TrimSpace(value) != "" {
+				empty = false
+			}
+			line += tools.separatorIn + value
+		}
+		if !empty {
+			input.WriteString(line + "\n")
+		}
+	}
+
+	withUID := tools.withUID
+	tools.withUID = true
+	tools.headerWritten = true
+	var output bytes.Buffer
+	writer := bufio.NewWriter(&output)
+	rowIdBefore, rowsSentBefore, rowsFailedBefore, rowsUncertainBefore := rowId, rowsSent, rowsFailed, rowsUncertain
+	err = tools.process(service, bufio.NewReader(strings.NewReader(input.String())), writer, softwareNameAndVersion, &summary)
+	tools.withUID = withUID
+	if err != nil {
+		return summary, err
+	}
+	summary.rowsWritten = rowId - rowIdBefore
+	summary.rowsSent = rowsSent - rowsSentBefore
+	summary.rowsFailed = rowsFailed - rowsFailedBefore
+	summary.rowsUncertain = rowsUncertain - rowsUncertainBefore
+
+	enrichedSheet := sheet
+	if len(enrichedSheet) > XLSX_SHEET_NAME_MAX-len(XLSX_SHEET_SUFFIX) {
+		enrichedSheet = enrichedSheet[:XLSX_SHEET_NAME_MAX-len(XLSX_SHEET_SUFFIX)]
+	}
+	enrichedSheet += XLSX_SHEET_SUFFIX
+	enrichedIndex, err := workbook.NewSheet(enrichedSheet)
+	if err != nil {
+		return summary, err
+	}
+	err = workbook.CopySheet(sheetIndex, enrichedIndex)
+	if err != nil {
+		return summary, err
+	}
+	appendedHeaders := append(append([]string{}, outputHeaders...), "version")
+	for i, appendedHeader := range appendedHeaders {
+		err = setXlsxCell(workbook, enrichedSheet, lastColumn+i+1, headerRow, appendedHeader)
+		if err != nil {
+			return summary, err
+		}
+	}
+	for i, line := range strings.Split(output.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lineData := strings.Split(line, tools.separatorOut)
+		rowNumber, err := strconv.Atoi(lineData[0])
+		if err != nil {
+			return summary, recordError{line: i, reason: LOG_REASON_ROW_NUMBER, message: "invalid row number in the enriched output", content: lineData[0]}
+		}
+		if tools.isDigest() {
+			// names in the enriched sheet are the digested ones
+			for i, column := range columns {
+				err = workbook.SetCellValue(enrichedSheet, xlsxCellName(column+1, rowNumber), lineData[1+i])
+				if err != nil {
+					return summary, err
+				}
+			}
+		}
+		values := lineData[1+len(columns):]
+		for i := range appendedHeaders {
+			if i >= len(values) {
+				break
+			}
+			err = setXlsxCell(workbook, enrichedSheet, lastColumn+i+1, rowNumber, values[i])
+			if err != nil {
+				return summary, err
+			}
+		}
+	}
+	if tools.isDigest() {
+		// don't keep the names in clear
+		err = workbook.DeleteSheet(sheet)
+		if err != nil {
+			return summary, err
+		}
+	}
+	enrichedIndex, _ = workbook.GetSheetIndex(enrichedSheet)
+	workbook.SetActiveSheet(enrichedIndex)
+	logger.Infof("Writing sheet %s to %s", enrichedSheet, outputFileName)
+	if tools.encryption == nil {
+		return summary, workbook.SaveAs(outputFileName)
+	}
+	// the workbook is encrypted as it is written
+	file, err := os.OpenFile(outputFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return summary, err
+	}
+	encrypted := &encryptedOutput{file: file}
+	encrypted.encrypter, err = tools.encryption.encrypt(file)
+	if err == nil {
+		err = workbook.Write(encrypted.encrypter)
+	}
+	if err != nil {
+		file.Close()
+		return summary, err
+	}
+	return summary, encrypted.Close()
+}
+
+// xlsxColumns finds the 0-based column of each input header, from a mapping such as firstName=B,lastName=Surname or else from the header row titles
+func xlsxColumns(headerCells []string, inputHeaders []string, mapping string) ([]int, error) {
+	mapped := map[string]string{}
+	if mapping != "" {
+		for _, pair := range strings.Split(mapping, ",") {
+			keyValue := strings.SplitN(pair, "=", 2)
+			if len(keyValue) != 2 || !contains(inputHeaders, strings.TrimSpace(keyValue[0])) {
+				return nil, errors.New(fmt.Sprintf("Invalid column mapping %s, expected %s=<column letter or title>", pair, strings.Join(inputHeaders, "|")))
+			}
+			mapped[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+		}
+	}
+	var columns []int
+	for _, inputHeader := range inputHeaders {
+		title, ok := mapped[inputHeader]
+		if !ok {
+			title = inputHeader
+		}
+		column := -1
+		for i, headerCell := range headerCells {
+			if strings.EqualFold(strings.TrimSpace(headerCell), title) {
+				column = i
+				break
+			}
+		}
+		if column < 0 && ok {
+			if number, err := excelize.ColumnNameToNumber(title); err == nil && strings.ToUpper(title) == title {
+				column = number - 1
+			}
+		}
+		if column < 0 {
+			return nil, errors.New(fmt.Sprintf("No column for %s, use --columns %s=<column letter or title>", inputHeader, inputHeader))
+		}
+		columns = append(columns, column)
+	}
+	return columns, nil
+}
+
+func xlsxCellName(column int, row int) string {
+	cellName, _ := excelize.CoordinatesToCellName(column, row)
+	return cellName
+}
+
+// setXlsxCell stores scores as numbers and flags as booleans, but not phone numbers
+func setXlsxCell(workbook *excelize.File, sheet string, column int, row int, value string) error {
+	cellName := xlsxCellName(column, row)
+	if number, err := strconv.ParseFloat(value, 64); err == nil && !strings.HasPrefix(value, "+") {
+		return workbook.SetCellValue(sheet, cellName, number)
+	}
+	if value == "true" || value == "false" {
+		return workbook.SetCellValue(sheet, cellName, value == "true")
+	}
+	return workbook.SetCellValue(sheet, cellName, value)
+}